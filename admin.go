@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// rejects requests without the ADMIN_TOKEN bearer token, the api is off when it is unset
+func requireAdmin(c *fiber.Ctx) error {
+	token := os.Getenv("ADMIN_TOKEN")
+	if token == "" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Admin API disabled"})
+	}
+
+	if subtle.ConstantTimeCompare([]byte(bearerToken(c)), []byte(token)) != 1 {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+	return c.Next()
+}
+
+func RegisterAdminRoutes(app *fiber.App) {
+	admin := app.Group("/admin", requireAdmin)
+
+	admin.Get("/matches", func(c *fiber.Ctx) error {
+		summaries := make([]AdminMatchSummary, 0)
+		local := make(map[string]bool)
+		for _, hash := range matchStore.Hashes() {
+			if match, exists := matchStore.GetMatch(hash); exists {
+				summaries = append(summaries, summarizeMatch(match))
+				local[hash] = true
+			}
+		}
+		// matches on other nodes as they last published them
+		for _, room := range ClusterRooms() {
+			if !local[room.Room.Hash] {
+				summaries = append(summaries, summarizeClusterRoom(room))
+			}
+		}
+		sort.Slice(summaries, func(i, j int) bool {
+			return summaries[i].CreatedAt.Before(summaries[j].CreatedAt)
+		})
+
+		return c.JSON(fiber.Map{
+			"node":    nodeID,
+			"matches": summaries,
+		})
+	})
+
+	admin.Get("/matches/:hash", func(c *fiber.Ctx) error {
+		hash := c.Params("hash")
+		match, exists := matchStore.GetMatch(hash)
+		if !exists {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": fmt.Sprintf("Match %s not found", hash)})
+		}
+
+		detail := AdminMatchDetail{AdminMatchSummary: summarizeMatch(match)}
+
+		match.mutex.RLock()
+		defer match.mutex.RUnlock()
+
+		detail.HostID = match.HostID
+		detail.GuestID = match.GuestID
+		detail.Config = match.Config
+		detail.GameState = &match.GameState
+		if match.IsMultiplayer() {
+			detail.Players = playersInfo(match)
+		}
+		return c.JSON(detail)
+	})
+
+	admin.Post("/matches/:hash/end", func(c *fiber.Ctx) error {
+		hash := c.Params("hash")
+		if err := ForceEndMatch(hash); err != nil {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+		}
+		LogAdminAction(hash, "force_end", logrus.Fields{})
+		return c.JSON(fiber.Map{"status": "ended"})
+	})
+
+	admin.Post("/matches/:hash/kick/:playerId", func(c *fiber.Ctx) error {
+		hash := c.Params("hash")
+		playerID := c.Params("playerId")
+		conn, err := matchStore.PlayerConnection(hash, playerID)
+		if err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		conn.WriteJSON(map[string]interface{}{"type": "error", "message": "Kicked by admin"})
+		closeConnection(conn, "Kicked by admin")
+		LogAdminAction(hash, "kick", logrus.Fields{"player_id": playerID})
+		return c.JSON(fiber.Map{"status": "kicked"})
+	})
+
+	admin.Delete("/matches/:hash", func(c *fiber.Ctx) error {
+		hash := c.Params("hash")
+		if _, exists := matchStore.GetMatch(hash); !exists {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": fmt.Sprintf("Match %s not found", hash)})
+		}
+
+		closeMatch(hash, "Match closed by admin")
+		LogAdminAction(hash, "delete", logrus.Fields{})
+		return c.JSON(fiber.Map{"status": "deleted"})
+	})
+
+	admin.Post("/tournaments", func(c *fiber.Ctx) error {
+		var request struct {
+			Players []string `json:"players"`
+			Format  string   `json:"format"`
+			BestOf  int      `json:"bestOf"`
+			Preset  string   `json:"preset"`
+			Rounds  int      `json:"rounds"`
+		}
+		if err := c.BodyParser(&request); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid payload"})
+		}
+		if request.Format == "" {
+			request.Format = "single"
+		}
+		if request.BestOf == 0 {
+			request.BestOf = 1
+		}
+
+		config := MatchConfigPreset(request.Preset)
+		if request.Rounds != 0 {
+			config.RoundCount = max(MinRoundCount, min(request.Rounds, MaxRoundCount))
+		}
+		config.Visibility = "unlisted"
+
+		tournament, err := CreateTournament(request.Players, request.Format, request.BestOf, config)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		LogAdminAction("", "create_tournament", logrus.Fields{"tournament_id": tournament.ID})
+
+		// the players need these with their ids to take their seats, they are not shown anywhere else
+		tokens := make(map[string]string)
+		for _, player := range request.Players {
+			tokens[player] = ReconnectToken(player)
+		}
+
+		tournament.mutex.Lock()
+		defer tournament.mutex.Unlock()
+		return c.Status(fiber.StatusCreated).JSON(struct {
+			*Tournament
+			Tokens map[string]string `json:"tokens"`
+		}{tournament, tokens})
+	})
+
+	admin.Post("/tournaments/:id/matches/:matchId/winner/:playerId", func(c *fiber.Ctx) error {
+		// params point into the request buffer, the winner is kept in the bracket
+		id := c.Params("id")
+		if err := AwardBracketMatch(id, c.Params("matchId"), strings.Clone(c.Params("playerId"))); err != nil {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+		}
+		LogAdminAction("", "award_bracket_match", logrus.Fields{
+			"tournament_id": id,
+			"bracket_match": c.Params("matchId"),
+			"player_id":     c.Params("playerId"),
+		})
+		return c.JSON(fiber.Map{"status": "awarded"})
+	})
+}
+
+func summarizeMatch(match *Match) AdminMatchSummary {
+	playerCount := GetPlayerCount(match)
+
+	match.mutex.RLock()
+	defer match.mutex.RUnlock()
+
+	return AdminMatchSummary{
+		Hash:           match.Hash,
+		Mode:           match.Config.Mode,
+		State:          match.State,
+		PlayerCount:    playerCount,
+		SpectatorCount: len(match.Spectators),
+		CurrentRound:   match.GameState.CurrentRound,
+		RoundCount:     len(match.GameState.Rounds),
+		CreatedAt:      match.CreatedAt,
+		AgeSeconds:     int64(time.Since(match.CreatedAt).Seconds()),
+		Node:           nodeID,
+	}
+}
+
+// what another node published about its match, spectators and the current round aren't in it
+func summarizeClusterRoom(room ClusterRoom) AdminMatchSummary {
+	return AdminMatchSummary{
+		Hash:        room.Room.Hash,
+		Mode:        room.Room.Mode,
+		State:       room.Room.State,
+		PlayerCount: room.Room.PlayerCount,
+		RoundCount:  room.Room.RoundCount,
+		CreatedAt:   room.Room.CreatedAt,
+		AgeSeconds:  int64(time.Since(room.Room.CreatedAt).Seconds()),
+		Node:        room.Node,
+	}
+}
+
+// ends a waiting or playing match right away with the scores so far
+func ForceEndMatch(hash string) error {
+	if _, exists := matchStore.GetMatch(hash); !exists {
+		return fmt.Errorf("Match %s not found", hash)
+	}
+
+	if !finishMatch(hash, true) {
+		return fmt.Errorf("Match %s already finished", hash)
+	}
+	return nil
+}
+
+// the live connection of a player or spectator in the match
+func (store *MatchStore) PlayerConnection(hash string, playerID string) (Connection, error) {
+	match, exists := store.GetMatch(hash)
+	if !exists {
+		return nil, fmt.Errorf("Match %s not found", hash)
+	}
+
+	match.mutex.RLock()
+	defer match.mutex.RUnlock()
+
+	var conn Connection
+	switch {
+	case playerID == "":
+	case playerID == match.HostID:
+		conn = match.HostConn
+	case playerID == match.GuestID:
+		conn = match.GuestConn
+	case match.Players[playerID] != nil:
+		conn = match.Players[playerID].Conn
+	case match.Spectators[playerID] != nil:
+		conn = match.Spectators[playerID].Conn
+	}
+
+	if conn == nil {
+		return nil, fmt.Errorf("Player %s not connected to match %s", playerID, hash)
+	}
+	return conn, nil
+}
+
+// every connection attached to the match, spectators included
+func (store *MatchStore) Connections(hash string) []Connection {
+	match, exists := store.GetMatch(hash)
+	if !exists {
+		return nil
+	}
+
+	match.mutex.RLock()
+	defer match.mutex.RUnlock()
+
+	var conns []Connection
+	if match.HostConn != nil {
+		conns = append(conns, match.HostConn)
+	}
+	if match.GuestConn != nil {
+		conns = append(conns, match.GuestConn)
+	}
+	for _, player := range match.Players {
+		if player.Conn != nil {
+			conns = append(conns, player.Conn)
+		}
+	}
+	for _, spectator := range match.Spectators {
+		conns = append(conns, spectator.Conn)
+	}
+	return conns
+}
+
+// tells everyone in the match why, drops their sockets and deletes the match
+func closeMatch(hash string, reason string) {
+	if _, exists := matchStore.GetMatch(hash); !exists {
+		return
+	}
+
+	matchStore.BroadcastToRoom(hash, map[string]interface{}{"type": "error", "message": reason})
+	for _, conn := range matchStore.Connections(hash) {
+		closeConnection(conn, reason)
+	}
+	matchStore.DeleteMatch(hash)
+}
+
+// sends a close frame, local sockets are also closed so their read loop ends
+func closeConnection(conn Connection, reason string) {
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason))
+	if ws, ok := unwrapConnection(conn).(*websocket.Conn); ok {
+		ws.Close()
+	}
+}
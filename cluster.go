@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+var nodeID = initNodeID()
+
+// a relay envelope reached nobody, the owner is gone or stopped listening
+var errOwnerNotListening = errors.New("Owner is not listening")
+
+const ownershipTTL = 30 * time.Second
+const ownershipRefreshInterval = 10 * time.Second
+
+// only touch the owner key if this node still holds it
+var refreshOwnershipScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+var takeOverOwnershipScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+	return 1
+end
+return 0
+`)
+
+var releaseOwnershipScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+func initNodeID() string {
+	if id := os.Getenv("NODE_ID"); id != "" {
+		return id
+	}
+	return uuid.NewString()
+}
+
+func ownerKey(hash string) string {
+	return "geofinder:match:" + hash + ":owner"
+}
+
+func nodeAliveKey(node string) string {
+	return "geofinder:node:" + node + ":alive"
+}
+
+func nodeChannel(node string) string {
+	return "geofinder:node:" + node + ":inbound"
+}
+
+func sessionChannel(sessionID string) string {
+	return "geofinder:session:" + sessionID
+}
+
+// carries close frames, which the relaying node turns into a real close
+func sessionCloseChannel(sessionID string) string {
+	return "geofinder:session:" + sessionID + ":close"
+}
+
+func sessionBinaryChannel(sessionID string) string {
+	return "geofinder:session:" + sessionID + ":binary"
+}
+
+// claims the room for this node unless another node already owns it, returns the owner
+func ClaimMatchOwnership(hash string) (string, error) {
+	if redisClient == nil {
+		return nodeID, nil
+	}
+
+	ctx := context.Background()
+	claimed, err := redisClient.SetNX(ctx, ownerKey(hash), nodeID, ownershipTTL).Result()
+	if err != nil {
+		LogRedisError("claim_ownership", err)
+		return "", err
+	}
+	if claimed {
+		LogClusterEvent(hash, "ownership_claimed", logrus.Fields{})
+		return nodeID, nil
+	}
+
+	owner, err := redisClient.Get(ctx, ownerKey(hash)).Result()
+	if err == redis.Nil {
+		// the previous owner expired between SETNX and GET, try again
+		return ClaimMatchOwnership(hash)
+	}
+	if err != nil {
+		LogRedisError("get_owner", err)
+		return "", err
+	}
+	if owner == nodeID {
+		return owner, nil
+	}
+
+	// the owner died without releasing the room (crash or deploy), take it over
+	alive, err := IsNodeAlive(owner)
+	if err != nil || alive {
+		return owner, nil
+	}
+	tookOver, err := takeOverOwnershipScript.Run(ctx, redisClient, []string{ownerKey(hash)}, owner, nodeID, ownershipTTL.Milliseconds()).Int()
+	if err != nil {
+		LogRedisError("take_over_ownership", err)
+		return owner, nil
+	}
+	if tookOver == 1 {
+		LogClusterEvent(hash, "ownership_taken_over", logrus.Fields{
+			"previous_owner": owner,
+		})
+		return nodeID, nil
+	}
+	return ClaimMatchOwnership(hash)
+}
+
+// takes the room from an owner that still holds the key but no longer answers relays
+func TakeOverMatchOwnership(hash string, owner string) bool {
+	if redisClient == nil {
+		return true
+	}
+
+	ctx := context.Background()
+	tookOver, err := takeOverOwnershipScript.Run(ctx, redisClient, []string{ownerKey(hash)}, owner, nodeID, ownershipTTL.Milliseconds()).Int()
+	if err != nil {
+		LogRedisError("take_over_ownership", err)
+		return false
+	}
+	if tookOver == 1 {
+		LogClusterEvent(hash, "ownership_taken_over", logrus.Fields{
+			"previous_owner": owner,
+			"reason":         "relay_unanswered",
+		})
+	}
+	return tookOver == 1
+}
+
+// stops a match another node took over and closes its sockets, the clients
+// reconnect and get relayed to the new owner, which restores the match from redis
+func handOverMatch(hash string, owner string) {
+	connections := matchStore.Connections(hash)
+	matchStore.UnloadMatch(hash)
+	for _, conn := range connections {
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseServiceRestart, "Room moved, reconnect"))
+		if ws, ok := unwrapConnection(conn).(*websocket.Conn); ok {
+			ws.Close()
+		}
+	}
+
+	LogClusterEvent(hash, "match_handed_over", logrus.Fields{
+		"owner":       owner,
+		"connections": len(connections),
+	})
+}
+
+func MarkNodeAlive() error {
+	if redisClient == nil {
+		return nil
+	}
+
+	ctx := context.Background()
+	return redisClient.Set(ctx, nodeAliveKey(nodeID), time.Now().Unix(), ownershipTTL).Err()
+}
+
+func IsNodeAlive(node string) (bool, error) {
+	if redisClient == nil {
+		return node == nodeID, nil
+	}
+
+	ctx := context.Background()
+	count, err := redisClient.Exists(ctx, nodeAliveKey(node)).Result()
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func RefreshMatchOwnership(hash string) (bool, error) {
+	if redisClient == nil {
+		return true, nil
+	}
+
+	ctx := context.Background()
+	refreshed, err := refreshOwnershipScript.Run(ctx, redisClient, []string{ownerKey(hash)}, nodeID, ownershipTTL.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+	return refreshed == 1, nil
+}
+
+func ReleaseMatchOwnership(hash string) error {
+	if redisClient == nil {
+		return nil
+	}
+
+	ctx := context.Background()
+	return releaseOwnershipScript.Run(ctx, redisClient, []string{ownerKey(hash)}, nodeID).Err()
+}
+
+// keeps this node's heartbeat and the owner keys of every local match alive
+func maintainMatchOwnership() {
+	ticker := time.NewTicker(ownershipRefreshInterval)
+	defer ticker.Stop()
+
+	if err := MarkNodeAlive(); err != nil {
+		LogRedisError("node_heartbeat", err)
+	}
+
+	for range ticker.C {
+		if err := MarkNodeAlive(); err != nil {
+			LogRedisError("node_heartbeat", err)
+		}
+
+		for _, hash := range matchStore.Hashes() {
+			owned, err := RefreshMatchOwnership(hash)
+			if err != nil {
+				LogRedisError("refresh_ownership", err)
+				continue
+			}
+			// a draining node holds on to its matches until handleShutdown has
+			// saved and released them, and never claims one back after that
+			if owned || draining.Load() {
+				continue
+			}
+
+			// the key expired or was taken over, reclaim it if nobody else holds it
+			owner, err := ClaimMatchOwnership(hash)
+			if err == nil && owner != nodeID {
+				LogClusterEvent(hash, "ownership_lost", logrus.Fields{
+					"owner": owner,
+				})
+				handOverMatch(hash, owner)
+			}
+		}
+	}
+}
+
+func (conn *RelayConn) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (conn *RelayConn) WriteMessage(messageType int, data []byte) error {
+	ctx := context.Background()
+	if messageType == websocket.CloseMessage {
+		return redisClient.Publish(ctx, sessionCloseChannel(conn.SessionID), data).Err()
+	}
+	if messageType == websocket.BinaryMessage {
+		return redisClient.Publish(ctx, sessionBinaryChannel(conn.SessionID), data).Err()
+	}
+	return redisClient.Publish(ctx, sessionChannel(conn.SessionID), data).Err()
+}
+
+func publishRelayEnvelope(owner string, envelope RelayEnvelope) error {
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	receivers, err := redisClient.Publish(ctx, nodeChannel(owner), data).Result()
+	if err != nil {
+		LogRedisError("relay_publish", err)
+		return err
+	}
+	if receivers == 0 {
+		LogClusterEvent(envelope.Hash, "relay_unanswered", logrus.Fields{
+			"session_id": envelope.SessionID,
+			"owner":      owner,
+		})
+		return errOwnerNotListening
+	}
+	return nil
+}
+
+// forwards a socket connected to this node to the node that owns its room,
+// returns errOwnerNotListening if the owner never picked the socket up
+func relayGameConnection(c *websocket.Conn, hash string, owner string, config MatchConfig, admitted bool) error {
+	sessionID := uuid.NewString()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pubsub := redisClient.Subscribe(ctx, sessionChannel(sessionID), sessionCloseChannel(sessionID), sessionBinaryChannel(sessionID))
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(ctx); err != nil {
+		LogRedisError("relay_subscribe", err)
+		c.WriteJSON(map[string]interface{}{"error": "Room unavailable"})
+		return nil
+	}
+
+	LogClusterEvent(hash, "relay_opened", logrus.Fields{
+		"session_id": sessionID,
+		"owner":      owner,
+	})
+
+	// drop the client if the owner dies so its reconnect lands on a live node
+	go func() {
+		ticker := time.NewTicker(ownershipRefreshInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if alive, err := IsNodeAlive(owner); err == nil && !alive {
+					LogClusterEvent(hash, "relay_owner_lost", logrus.Fields{
+						"session_id": sessionID,
+						"owner":      owner,
+					})
+					c.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	var writeMutex sync.Mutex
+	go func() {
+		for msg := range pubsub.Channel() {
+			if msg.Channel == sessionCloseChannel(sessionID) {
+				writeMutex.Lock()
+				c.WriteMessage(websocket.CloseMessage, []byte(msg.Payload))
+				writeMutex.Unlock()
+				c.Close()
+				return
+			}
+
+			messageType := websocket.TextMessage
+			if msg.Channel == sessionBinaryChannel(sessionID) {
+				messageType = websocket.BinaryMessage
+			}
+
+			writeMutex.Lock()
+			err := c.WriteMessage(messageType, []byte(msg.Payload))
+			writeMutex.Unlock()
+			if err != nil {
+				LogBroadcastError(hash, "relay", err)
+			}
+		}
+	}()
+
+	envelope := RelayEnvelope{
+		SessionID: sessionID,
+		Hash:      hash,
+		Origin:    nodeID,
+	}
+
+	open := envelope
+	open.Kind = "open"
+	open.Config = &config
+	open.Admitted = admitted
+	if err := publishRelayEnvelope(owner, open); err != nil {
+		if err == errOwnerNotListening {
+			return err
+		}
+		writeMutex.Lock()
+		c.WriteJSON(map[string]interface{}{"error": "Room unavailable"})
+		writeMutex.Unlock()
+		return nil
+	}
+
+	for {
+		messageType, data, err := c.ReadMessage()
+		if err != nil {
+			break
+		}
+
+		message := envelope
+		message.Kind = "message"
+		switch messageType {
+		case websocket.TextMessage:
+			message.Payload = string(data)
+		case websocket.BinaryMessage:
+			message.Binary = data
+		default:
+			continue
+		}
+		if publishRelayEnvelope(owner, message) == errOwnerNotListening {
+			// drop the client so its reconnect can take the room over
+			break
+		}
+	}
+
+	closed := envelope
+	closed.Kind = "close"
+	publishRelayEnvelope(owner, closed)
+
+	LogClusterEvent(hash, "relay_closed", logrus.Fields{
+		"session_id": sessionID,
+		"owner":      owner,
+	})
+	return nil
+}
+
+// handles sockets that other nodes relay to the rooms owned by this node
+func SubscribeToRelayedConnections(ctx context.Context, router *EventRouter) {
+	channel := nodeChannel(nodeID)
+	pubsub := redisClient.Subscribe(ctx, channel)
+	defer pubsub.Close()
+
+	LogRedisSubscribe(channel)
+
+	sessions := make(map[string]*relayedSession)
+
+	for msg := range pubsub.Channel() {
+		var envelope RelayEnvelope
+		if err := json.Unmarshal([]byte(msg.Payload), &envelope); err != nil {
+			continue
+		}
+
+		switch envelope.Kind {
+		case "open":
+			config := DefaultMatchConfig()
+			if envelope.Config != nil {
+				config = *envelope.Config
+			}
+			created := openMatch(envelope.Hash, config)
+
+			relayed := &relayedSession{
+				session: &GameSession{
+					Hash:   envelope.Hash,
+					Conn:   NewProtocolConn(&RelayConn{SessionID: envelope.SessionID}),
+					Router: router,
+				},
+				inbox: make(chan relayedFrame, 64),
+			}
+			if created || envelope.Admitted {
+				relayed.session.Conn.Admit()
+			}
+			sessions[envelope.SessionID] = relayed
+
+			// handlers can block (auth waits for the prefetch), so every session gets its own worker
+			go func(relayed *relayedSession) {
+				for frame := range relayed.inbox {
+					relayed.session.HandleFrame(frame.messageType, frame.data)
+				}
+				relayed.session.Close()
+			}(relayed)
+
+			LogWebSocketConnection(envelope.Hash, "", "", true)
+			LogClusterEvent(envelope.Hash, "relay_accepted", logrus.Fields{
+				"session_id": envelope.SessionID,
+				"origin":     envelope.Origin,
+			})
+		case "message":
+			if relayed, ok := sessions[envelope.SessionID]; ok {
+				frame := relayedFrame{messageType: websocket.TextMessage, data: []byte(envelope.Payload)}
+				if envelope.Binary != nil {
+					frame = relayedFrame{messageType: websocket.BinaryMessage, data: envelope.Binary}
+				}
+
+				select {
+				case relayed.inbox <- frame:
+				default:
+					LogClusterEvent(envelope.Hash, "relay_inbox_full", logrus.Fields{
+						"session_id": envelope.SessionID,
+					})
+				}
+			}
+		case "close":
+			if relayed, ok := sessions[envelope.SessionID]; ok {
+				close(relayed.inbox)
+				delete(sessions, envelope.SessionID)
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"github.com/gofiber/websocket/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// wire encodings a client can pick in hello, every socket starts out on json
+const EncodingJSON string = "json"
+const EncodingMsgpack string = "msgpack"
+
+var ServerEncodings = []string{EncodingJSON, EncodingMsgpack}
+
+// the first encoding in the client's preference list that the server speaks
+func pickEncoding(preferred []string) string {
+	for _, encoding := range preferred {
+		if slices.Contains(ServerEncodings, encoding) {
+			return encoding
+		}
+	}
+	return EncodingJSON
+}
+
+func (conn *ProtocolConn) Encoding() string {
+	conn.mutex.RLock()
+	defer conn.mutex.RUnlock()
+
+	if conn.encoding == "" {
+		return EncodingJSON
+	}
+	return conn.encoding
+}
+
+func (conn *ProtocolConn) SetEncoding(encoding string) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	conn.encoding = encoding
+}
+
+// turns an outgoing json text frame into the connection's encoding
+func (conn *ProtocolConn) encodeFrame(data []byte) (int, []byte, error) {
+	if conn.Encoding() != EncodingMsgpack {
+		return websocket.TextMessage, data, nil
+	}
+
+	encoded, err := jsonToMsgpack(data)
+	if err != nil {
+		return 0, nil, err
+	}
+	return websocket.BinaryMessage, encoded, nil
+}
+
+// turns an incoming binary frame into the json envelope the router expects
+func (conn *ProtocolConn) DecodeBinary(data []byte) ([]byte, error) {
+	if conn.Encoding() != EncodingMsgpack {
+		return nil, fmt.Errorf("Binary frames need a negotiated encoding")
+	}
+	return msgpackToJSON(data)
+}
+
+func jsonToMsgpack(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		// bare text frames like pong get wrapped, same as in version 2
+		value = map[string]interface{}{"type": string(data)}
+	}
+	return msgpack.Marshal(msgpackValue(value))
+}
+
+// json numbers become msgpack integers where they fit, floats otherwise
+func msgpackValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = msgpackValue(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = msgpackValue(item)
+		}
+	}
+	return value
+}
+
+func msgpackToJSON(data []byte) ([]byte, error) {
+	var value interface{}
+	if err := msgpack.Unmarshal(data, &value); err != nil {
+		return nil, fmt.Errorf("Invalid msgpack frame")
+	}
+	return json.Marshal(value)
+}
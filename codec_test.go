@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// decodes json with exact numbers so large ids and floats compare as written
+func decodeJSON(t *testing.T, data []byte) interface{} {
+	t.Helper()
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		t.Fatalf("invalid json %s: %v", data, err)
+	}
+	return value
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want string // what comes back, when it differs from json
+	}{
+		{"event", `{"event":"submit_answer","data":{"countryCode":"FR"}}`, ""},
+		{"numbers", `{"seq":42,"negative":-7,"lat":48.8566,"zero":0}`, ""},
+		{"large integer", `{"seq":9007199254740993}`, ""},
+		{"nested", `{"type":"game_end","standings":[{"playerId":"a","rank":1},{"playerId":"b","rank":2}],"teamScores":{"red":3}}`, ""},
+		{"null and bools", `{"id":null,"finished":true,"ready":false}`, ""},
+		{"empty containers", `{"players":[],"config":{}}`, ""},
+		{"unicode", `{"countryName":"Côte d’Ivoire"}`, ""},
+		{"bare text is wrapped", `pong`, `{"type":"pong"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packed, err := jsonToMsgpack([]byte(test.json))
+			if err != nil {
+				t.Fatalf("jsonToMsgpack(%s) error: %v", test.json, err)
+			}
+			unpacked, err := msgpackToJSON(packed)
+			if err != nil {
+				t.Fatalf("msgpackToJSON() error: %v", err)
+			}
+
+			want := test.want
+			if want == "" {
+				want = test.json
+			}
+			if got, expected := decodeJSON(t, unpacked), decodeJSON(t, []byte(want)); !reflect.DeepEqual(got, expected) {
+				t.Errorf("round trip of %s gave %s, want %s", test.json, unpacked, want)
+			}
+		})
+	}
+}
+
+func TestJSONToMsgpackNumbers(t *testing.T) {
+	packed, err := jsonToMsgpack([]byte(`{"seq":3,"lat":1.5,"big":9007199254740993}`))
+	if err != nil {
+		t.Fatalf("jsonToMsgpack() error: %v", err)
+	}
+
+	var message map[string]interface{}
+	if err := msgpack.Unmarshal(packed, &message); err != nil {
+		t.Fatalf("not msgpack: %v", err)
+	}
+
+	tests := []struct {
+		key  string
+		want interface{}
+	}{
+		{"seq", int64(3)},
+		{"lat", 1.5},
+		{"big", int64(9007199254740993)},
+	}
+	for _, test := range tests {
+		if got := message[test.key]; got != test.want {
+			t.Errorf("%s decoded as %T(%v), want %T(%v)", test.key, got, got, test.want, test.want)
+		}
+	}
+}
+
+func TestMsgpackToJSONRejectsGarbage(t *testing.T) {
+	for _, data := range [][]byte{{}, {0xc1}, {0x81, 0xa1}} {
+		if _, err := msgpackToJSON(data); err == nil {
+			t.Errorf("msgpackToJSON(%x) accepted invalid msgpack", data)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+const MinFFAPlayers int = 3
+const MaxFFAPlayers int = 8
+const DefaultFFAPlayers int = 4
+const MinTeamPlayers int = 4
+const MaxTeamPlayers int = 8
+
+const DefaultRoundCount int = 5
+const MinRoundCount int = 1
+const MaxRoundCount int = 25
+
+const MinRoundSeconds int = 5
+const MaxRoundSeconds int = 300
+const MaxIntermissionSeconds int = 30
+const MinReadyTimeoutSeconds int = 5
+const MaxReadyTimeoutSeconds int = 120
+const MaxSpectatorDelaySeconds int = 60
+const MaxRegionLength int = 16
+
+func DefaultMatchConfig() MatchConfig {
+	return MatchConfig{
+		Mode:                  "1v1",
+		MaxPlayers:            2,
+		Preset:                "standard",
+		ScoringMode:           "country",
+		RoundCount:            DefaultRoundCount,
+		RoundSeconds:          30,
+		IntermissionSeconds:   3,
+		ReadyTimeoutSeconds:   30,
+		SpectatorDelaySeconds: 5,
+	}
+}
+
+// returns the timings for a named lobby preset, falling back to standard
+func MatchConfigPreset(preset string) MatchConfig {
+	config := DefaultMatchConfig()
+
+	switch preset {
+	case "blitz":
+		config.Preset = "blitz"
+		config.RoundSeconds = 10
+		config.IntermissionSeconds = 2
+	case "relaxed":
+		config.Preset = "relaxed"
+		config.RoundSeconds = 90
+		config.IntermissionSeconds = 5
+		config.ReadyTimeoutSeconds = 60
+	}
+
+	return config
+}
+
+// regions are matched lowercased, false when it is too long to be one
+func normalizeRegion(region string) (string, bool) {
+	region = strings.ToLower(region)
+	return region, len(region) <= MaxRegionLength
+}
+
+// reads the match config from the query params of the connection that creates the room
+func ParseMatchConfig(c *websocket.Conn) MatchConfig {
+	config := MatchConfigPreset(c.Query("preset"))
+
+	switch c.Query("mode") {
+	case "ffa":
+		config.Mode = "ffa"
+		config.MaxPlayers = DefaultFFAPlayers
+		if players, err := strconv.Atoi(c.Query("maxPlayers")); err == nil {
+			config.MaxPlayers = max(MinFFAPlayers, min(players, MaxFFAPlayers))
+		}
+	case "teams":
+		config.Mode = "teams"
+		config.MaxPlayers = MinTeamPlayers
+		if players, err := strconv.Atoi(c.Query("maxPlayers")); err == nil {
+			// teams are always the same size
+			config.MaxPlayers = max(MinTeamPlayers, min(players-players%2, MaxTeamPlayers))
+		}
+		config.TeamScoring = "best"
+		if c.Query("teamScoring") == "combined" {
+			config.TeamScoring = "combined"
+		}
+	}
+
+	switch c.Query("visibility") {
+	case "unlisted":
+		config.Visibility = "unlisted"
+	case "private":
+		config.Visibility = "private"
+	}
+
+	if region, ok := normalizeRegion(c.Query("region")); ok {
+		config.Region = region
+	}
+
+	switch c.Query("scoringMode") {
+	case "distance":
+		config.ScoringMode = "distance"
+	case "country":
+		config.ScoringMode = "country"
+	}
+
+	if rounds, err := strconv.Atoi(c.Query("rounds")); err == nil {
+		config.RoundCount = max(MinRoundCount, min(rounds, MaxRoundCount))
+	}
+	if seconds, err := strconv.Atoi(c.Query("roundSeconds")); err == nil {
+		config.RoundSeconds = max(MinRoundSeconds, min(seconds, MaxRoundSeconds))
+	}
+	if seconds, err := strconv.Atoi(c.Query("intermissionSeconds")); err == nil {
+		config.IntermissionSeconds = max(0, min(seconds, MaxIntermissionSeconds))
+	}
+	if seconds, err := strconv.Atoi(c.Query("readyTimeoutSeconds")); err == nil {
+		config.ReadyTimeoutSeconds = max(MinReadyTimeoutSeconds, min(seconds, MaxReadyTimeoutSeconds))
+	}
+	if seconds, err := strconv.Atoi(c.Query("spectatorDelaySeconds")); err == nil {
+		config.SpectatorDelaySeconds = max(0, min(seconds, MaxSpectatorDelaySeconds))
+	}
+
+	return config
+}
+
+func (config MatchConfig) RoundDuration() time.Duration {
+	return time.Duration(config.RoundSeconds) * time.Second
+}
+
+func (config MatchConfig) Intermission() time.Duration {
+	return time.Duration(config.IntermissionSeconds) * time.Second
+}
+
+func (config MatchConfig) ReadyTimeout() time.Duration {
+	return time.Duration(config.ReadyTimeoutSeconds) * time.Second
+}
+
+func (config MatchConfig) SpectatorDelay() time.Duration {
+	return time.Duration(config.SpectatorDelaySeconds) * time.Second
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+const DefaultRoomsPageSize int = 20
+const MaxRoomsPageSize int = 100
+
+// builds a filter from the discovery query string, only waiting rooms by default
+func ParseDiscoveryFilter(c *websocket.Conn) DiscoveryFilter {
+	filter := DiscoveryFilter{
+		State:  c.Query("state", "waiting"),
+		Mode:   c.Query("mode"),
+		Region: strings.ToLower(c.Query("region")),
+	}
+	if filter.State == "any" {
+		filter.State = ""
+	}
+	if rounds, err := strconv.Atoi(c.Query("rounds")); err == nil {
+		filter.RoundCount = rounds
+	}
+	filter.OpenSeat = c.Query("openSeat") == "true"
+	return filter
+}
+
+// reads a filter sent with the subscribe event, same defaults as the query string
+func discoveryFilterFromData(data map[string]interface{}) DiscoveryFilter {
+	filter := DiscoveryFilter{State: "waiting"}
+	if state, ok := data["state"].(string); ok && state != "" {
+		filter.State = state
+	}
+	if filter.State == "any" {
+		filter.State = ""
+	}
+	filter.Mode, _ = data["mode"].(string)
+	region, _ := data["region"].(string)
+	filter.Region = strings.ToLower(region)
+	if rounds, ok := data["rounds"].(float64); ok {
+		filter.RoundCount = int(rounds)
+	}
+	filter.OpenSeat, _ = data["openSeat"].(bool)
+	return filter
+}
+
+func (filter DiscoveryFilter) Matches(room RoomStatePayload) bool {
+	if filter.State != "" && room.State != filter.State {
+		return false
+	}
+	if filter.Mode != "" && room.Mode != filter.Mode {
+		return false
+	}
+	if filter.RoundCount != 0 && room.RoundCount != filter.RoundCount {
+		return false
+	}
+	if filter.Region != "" && room.Region != filter.Region {
+		return false
+	}
+	if filter.OpenSeat && room.PlayerCount >= room.MaxPlayers {
+		return false
+	}
+	return true
+}
+
+// one page of the rooms in the cluster that match the filter, newest first,
+// rooms on this node are read from memory rather than their last published state
+func (store *MatchStore) ListRooms(filter DiscoveryFilter, page int, pageSize int) RoomsListPayload {
+	listed := make(map[string]RoomStatePayload)
+	for _, room := range ClusterRooms() {
+		if room.Listed {
+			listed[room.Room.Hash] = room.Room
+		}
+	}
+	for _, hash := range store.Hashes() {
+		delete(listed, hash)
+		if match, exists := store.GetMatch(hash); exists && match.IsListed() {
+			listed[hash] = roomState(match)
+		}
+	}
+
+	rooms := make([]RoomStatePayload, 0)
+	for _, room := range listed {
+		if filter.Matches(room) {
+			rooms = append(rooms, room)
+		}
+	}
+	// ties broken by hash so pages don't shuffle between requests
+	sort.Slice(rooms, func(i, j int) bool {
+		if !rooms[i].CreatedAt.Equal(rooms[j].CreatedAt) {
+			return rooms[i].CreatedAt.After(rooms[j].CreatedAt)
+		}
+		return rooms[i].Hash < rooms[j].Hash
+	})
+
+	start := min((page-1)*pageSize, len(rooms))
+	end := min(start+pageSize, len(rooms))
+	return RoomsListPayload{
+		Type:     "rooms_list",
+		Data:     rooms[start:end],
+		Page:     page,
+		PageSize: pageSize,
+		Total:    len(rooms),
+	}
+}
+
+func (subscriber *DiscoverySubscriber) sendRoomsList(page int, pageSize int) {
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+
+	list := matchStore.ListRooms(subscriber.Filter, page, pageSize)
+	// rooms in the snapshot count as seen, so leaving the filter later is reported
+	for _, room := range list.Data {
+		subscriber.visible[room.Hash] = true
+	}
+	subscriber.Conn.WriteJSON(list)
+}
+
+// forwards a room update if the room matches the filter, or if it matched
+// before so the client can drop it
+func (subscriber *DiscoverySubscriber) Offer(room RoomStatePayload, raw []byte) error {
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+
+	if subscriber.Filter.Matches(room) {
+		subscriber.visible[room.Hash] = true
+	} else if subscriber.visible[room.Hash] {
+		delete(subscriber.visible, room.Hash)
+	} else {
+		return nil
+	}
+	return subscriber.Conn.WriteMessage(websocket.TextMessage, raw)
+}
+
+// writes to the socket from the connection handler, Offer and sendRoomsList hold the lock already
+func (subscriber *DiscoverySubscriber) WriteJSON(v interface{}) error {
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+
+	return subscriber.Conn.WriteJSON(v)
+}
+
+func (subscriber *DiscoverySubscriber) WriteMessage(messageType int, data []byte) error {
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+
+	return subscriber.Conn.WriteMessage(messageType, data)
+}
+
+func pageParams(data map[string]interface{}) (int, int) {
+	page, pageSize := 1, DefaultRoomsPageSize
+	if n, ok := data["page"].(float64); ok {
+		page = max(1, int(n))
+	}
+	if n, ok := data["pageSize"].(float64); ok {
+		pageSize = max(1, min(int(n), MaxRoomsPageSize))
+	}
+	return page, pageSize
+}
+
+func handleDiscoveryConnection(c *websocket.Conn) {
+	subscriber := &DiscoverySubscriber{
+		Conn:    c,
+		Filter:  ParseDiscoveryFilter(c),
+		visible: make(map[string]bool),
+	}
+
+	discoveryMutex.Lock()
+	discoveryConnections = append(discoveryConnections, subscriber)
+	total := len(discoveryConnections)
+	discoveryMutex.Unlock()
+	activeDiscoveryConnections.Add(1)
+	LogDiscoveryConnection(true, total)
+
+	defer func() {
+		discoveryMutex.Lock()
+		for i, other := range discoveryConnections {
+			if other == subscriber {
+				discoveryConnections = append(discoveryConnections[:i], discoveryConnections[i+1:]...)
+				break
+			}
+		}
+		total := len(discoveryConnections)
+		discoveryMutex.Unlock()
+		activeDiscoveryConnections.Add(-1)
+		LogDiscoveryConnection(false, total)
+	}()
+
+	// Send initial rooms
+	subscriber.sendRoomsList(1, DefaultRoomsPageSize)
+
+	for {
+		messageType, data, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+		if messageType != websocket.TextMessage {
+			continue
+		}
+
+		var message struct {
+			Event string                 `json:"event"`
+			Data  map[string]interface{} `json:"data"`
+		}
+		if err := json.Unmarshal(data, &message); err != nil {
+			subscriber.WriteJSON(map[string]interface{}{"type": "error", "message": "invalid payload"})
+			continue
+		}
+
+		switch message.Event {
+		case "ping":
+			subscriber.WriteMessage(websocket.TextMessage, []byte("pong"))
+		case "subscribe":
+			subscriber.mutex.Lock()
+			subscriber.Filter = discoveryFilterFromData(message.Data)
+			subscriber.visible = make(map[string]bool)
+			subscriber.mutex.Unlock()
+			subscriber.sendRoomsList(pageParams(message.Data))
+		case "list_rooms":
+			subscriber.sendRoomsList(pageParams(message.Data))
+		default:
+			subscriber.WriteMessage(websocket.TextMessage, []byte("Unknown event: "+message.Event))
+		}
+	}
+}
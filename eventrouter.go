@@ -1,22 +1,74 @@
 package main
 
-import "github.com/gofiber/websocket/v2"
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
 
 // registers an event and its handler
 func (router *EventRouter) On(event string, handler EventHandler) {
 	router.handlers[event] = handler
 }
 
-// routes incoming event to the appropriate handler
-func (router *EventRouter) Handle(conn *websocket.Conn, event string, data interface{}) {
-	if handler, ok := router.handlers[event]; ok {
-		handler(conn, data)
-	} else {
-		// Handle unknown events
-		conn.WriteMessage(websocket.TextMessage, []byte("Unknown event: "+event))
+// routes incoming event to the appropriate handler and makes sure it gets its
+// one reply, handlers that block can send the ack early with AckEvent
+func (router *EventRouter) Handle(conn *ProtocolConn, hash string, event string, id json.RawMessage, data json.RawMessage) {
+	conn.beginReply(event, id)
+	defer func() {
+		if r := recover(); r != nil {
+			LogWithFields(logrus.Fields{
+				"event":       "handler_panic",
+				"room_hash":   hash,
+				"event_name":  event,
+				"panic_value": fmt.Sprint(r),
+			}).Error("Event handler panicked")
+			conn.Reply(NewProtocolError(ErrInternal, "Internal error"))
+		}
+	}()
+
+	handler, ok := router.handlers[event]
+	if !ok {
+		conn.Reply(NewProtocolError(ErrUnknownEvent, "Unknown event: "+event))
+		return
 	}
+	conn.Reply(handler(conn, hash, data))
 }
 
 func NewEventRouter() *EventRouter {
 	return &EventRouter{handlers: make(map[string]EventHandler)}
 }
+
+func (conn *ProtocolConn) beginReply(event string, id json.RawMessage) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	conn.reply = &EventReply{Event: event, ID: id}
+}
+
+// answers the event being handled with an ack, or the error, only the first
+// call counts and events without an id only ever get errors
+func (conn *ProtocolConn) Reply(err *ProtocolError) {
+	conn.mutex.Lock()
+	reply := conn.reply
+	if reply == nil || reply.Sent {
+		conn.mutex.Unlock()
+		return
+	}
+	reply.Sent = true
+	conn.mutex.Unlock()
+
+	if err != nil {
+		sendError(conn, reply.Event, reply.ID, err)
+	} else if len(reply.ID) > 0 {
+		conn.WriteJSON(AckPayload{Type: "ack", ID: reply.ID, Event: reply.Event})
+	}
+}
+
+// acks the event a handler is working on before the handler returns
+func AckEvent(conn Connection) {
+	if protocolConn, ok := conn.(*ProtocolConn); ok {
+		protocolConn.Reply(nil)
+	}
+}
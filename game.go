@@ -1,6 +1,7 @@
 package main
 
 import (
+	"math"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -9,11 +10,15 @@ import (
 func PrefetchRounds(match *Match) (ok bool, err error) {
 	LogMatchLifecycle(match.Hash, "prefetch_start", logrus.Fields{})
 
-	for i := range 5 {
+	match.mutex.RLock()
+	roundCount := len(match.GameState.Rounds)
+	match.mutex.RUnlock()
+
+	for i := range roundCount {
 		var imgResp ImageResponse
 
 		for j := range 5 {
-			imgResp, err = GetImage()
+			imgResp, err = timedGetImage()
 			if err == nil {
 				LogGameRound(match.Hash, i+1, "image_fetched", logrus.Fields{
 					"image_url": imgResp.ImageURL,
@@ -53,18 +58,79 @@ func PrefetchRounds(match *Match) (ok bool, err error) {
 	return true, nil
 }
 
-func GetRoundResult(round *Round) (hostCorrect bool, guestCorrect bool) {
-	hostCorrect = round.HostGuess != nil && (round.HostGuess.CountryCode == round.CountryCode || round.HostGuess.CountryName == round.CountryName)
-	guestCorrect = round.GuestGuess != nil && (round.GuestGuess.CountryCode == round.CountryCode || round.GuestGuess.CountryName == round.CountryName)
-	return
+const EarthRadiusKm float64 = 6371.0
+const MaxRoundPoints int = 5000
+
+// falloff distance of the scoring curve, same as geoguessr's world map
+const DistanceScaleKm float64 = 1492.7
+
+func IsAnswerCorrect(round *Round, answer *PlayerAnswer) bool {
+	if answer == nil {
+		return false
+	}
+	if answer.CountryCode != "" && answer.CountryCode == round.CountryCode {
+		return true
+	}
+	return answer.CountryName != "" && answer.CountryName == round.CountryName
+}
+
+// great-circle distance between two points in km
+func HaversineDistance(a, b Coordinates) float64 {
+	lat1 := a.Lat * math.Pi / 180
+	lat2 := b.Lat * math.Pi / 180
+	dLat := (b.Lat - a.Lat) * math.Pi / 180
+	dLon := (b.Lon - a.Lon) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * EarthRadiusKm * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// 0-5000 points, decaying exponentially with distance
+func DistancePoints(distanceKm float64) int {
+	if distanceKm < 0 {
+		distanceKm = 0
+	}
+	return int(math.Round(float64(MaxRoundPoints) * math.Exp(-distanceKm/DistanceScaleKm)))
+}
+
+func IsValidPin(pin *Coordinates) bool {
+	return pin != nil && pin.Lat >= -90 && pin.Lat <= 90 && pin.Lon >= -180 && pin.Lon <= 180
+}
+
+// fills in Correct, Distance and Points on an answer for the given scoring mode
+func ScoreAnswer(round *Round, answer *PlayerAnswer, scoringMode string) {
+	if answer == nil {
+		return
+	}
+
+	answer.Correct = IsAnswerCorrect(round, answer)
+	answer.Distance = nil
+	if answer.Pin != nil {
+		distance := HaversineDistance(*answer.Pin, round.Coordinates)
+		answer.Distance = &distance
+	}
+
+	switch scoringMode {
+	case "distance":
+		if answer.Distance != nil {
+			answer.Points = DistancePoints(*answer.Distance)
+		} else {
+			answer.Points = 0
+		}
+	default:
+		if answer.Correct {
+			answer.Points = 1
+		} else {
+			answer.Points = 0
+		}
+	}
 }
 
 func IsRoundTimeUp(round *Round) bool {
-	if round.StartedAt.IsZero() {
+	if round.StartedAt.IsZero() || round.EndTime.IsZero() {
 		return false
 	}
-	elapsed := time.Since(round.StartedAt)
-	return elapsed >= 30*time.Second
+	return !time.Now().Before(round.EndTime)
 }
 
 func GetWinner(hostscore, guestscore int) string {
@@ -81,7 +147,7 @@ func GetPlayerCount(match *Match) int {
 	match.mutex.RLock()
 	defer match.mutex.RUnlock()
 
-	count := 0
+	count := connectedPlayerCount(match)
 	if match.HostConn != nil {
 		count++
 	}
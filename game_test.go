@@ -0,0 +1,55 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestHaversineDistance(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b Coordinates
+		want float64
+	}{
+		{"same point", Coordinates{Lat: 48.8566, Lon: 2.3522}, Coordinates{Lat: 48.8566, Lon: 2.3522}, 0},
+		{"paris to london", Coordinates{Lat: 48.8566, Lon: 2.3522}, Coordinates{Lat: 51.5074, Lon: -0.1278}, 343.556},
+		{"half the equator", Coordinates{Lat: 0, Lon: 0}, Coordinates{Lat: 0, Lon: 180}, 20015.087},
+		{"pole to pole", Coordinates{Lat: 90, Lon: 0}, Coordinates{Lat: -90, Lon: 0}, 20015.087},
+		{"across the antimeridian", Coordinates{Lat: 0, Lon: 179.5}, Coordinates{Lat: 0, Lon: -179.5}, 111.195},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := HaversineDistance(test.a, test.b)
+			if math.Abs(got-test.want) > 0.001 {
+				t.Errorf("HaversineDistance() = %.3f, want %.3f", got, test.want)
+			}
+			if reverse := HaversineDistance(test.b, test.a); math.Abs(reverse-got) > 1e-9 {
+				t.Errorf("HaversineDistance() is not symmetric: %.6f and %.6f", got, reverse)
+			}
+		})
+	}
+}
+
+func TestDistancePoints(t *testing.T) {
+	tests := []struct {
+		name       string
+		distanceKm float64
+		want       int
+	}{
+		{"exact pin", 0, MaxRoundPoints},
+		{"negative distance", -5, MaxRoundPoints},
+		{"100 km", 100, 4676},
+		{"one scale length", DistanceScaleKm, 1839},
+		{"5000 km", 5000, 175},
+		{"other side of the world", 20015.087, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := DistancePoints(test.distanceKm); got != test.want {
+				t.Errorf("DistancePoints(%v) = %d, want %d", test.distanceKm, got, test.want)
+			}
+		})
+	}
+}
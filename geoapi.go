@@ -4,14 +4,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"time"
+	"net/url"
 )
 
 const API_BASE_URL string = "https://geo.api.oof2510.space/"
 
-func GetImage() (ImageResponse, error) {
-	client := &http.Client{Timeout: 30 * time.Second}
-	res, err := client.Get(API_BASE_URL + "getImage")
+func (provider *HTTPImageProvider) GetImage() (ImageResponse, error) {
+	res, err := provider.Client.Get(provider.BaseURL + "getImage")
 	if err != nil {
 		return ImageResponse{}, err
 	}
@@ -29,23 +28,22 @@ func GetImage() (ImageResponse, error) {
 	return result, nil
 }
 
-func VerifyHash(hash string) (VerifyHashResponse, error) {
-	client := &http.Client{Timeout: 30 * time.Second}
-	res, err := client.Get(API_BASE_URL + "1v1/verify?hash=" + hash)
+func (verifier *RemoteHashVerifier) Verify(hash string) (bool, error) {
+	res, err := verifier.Client.Get(verifier.BaseURL + "1v1/verify?hash=" + url.QueryEscape(hash))
 	if err != nil {
 		LogRedisError("hash_verify", err)
-		return VerifyHashResponse{}, err
+		return false, err
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
-		return VerifyHashResponse{}, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+		return false, fmt.Errorf("unexpected status code: %d", res.StatusCode)
 	}
 
 	var result VerifyHashResponse
 	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
-		return VerifyHashResponse{}, err
+		return false, err
 	}
 
-	return result, nil
+	return result.Ok, nil
 }
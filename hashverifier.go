@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type HashVerifier interface {
+	Verify(hash string) (bool, error)
+}
+
+// asks the geo api whether a room hash is valid
+type RemoteHashVerifier struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+// checks "<roomId>.<hex hmac-sha256 of roomId>" hashes against a shared secret
+type HMACHashVerifier struct {
+	secret []byte
+}
+
+// accepts every non-empty hash, for local development only
+type AllowAllHashVerifier struct{}
+
+type cachedVerification struct {
+	ok        bool
+	expiresAt time.Time
+}
+
+// caches the results of another verifier so reconnects don't hit it every time
+type CachingHashVerifier struct {
+	verifier HashVerifier
+	ttl      time.Duration
+	mutex    sync.Mutex
+	entries  map[string]cachedVerification
+}
+
+const maxCachedVerifications int = 10000
+
+func NewRemoteHashVerifier(baseURL string) *RemoteHashVerifier {
+	return &RemoteHashVerifier{
+		BaseURL: baseURL,
+		Client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func NewHMACHashVerifier(secret string) *HMACHashVerifier {
+	return &HMACHashVerifier{secret: []byte(secret)}
+}
+
+func NewCachingHashVerifier(verifier HashVerifier, ttl time.Duration) *CachingHashVerifier {
+	return &CachingHashVerifier{
+		verifier: verifier,
+		ttl:      ttl,
+		entries:  make(map[string]cachedVerification),
+	}
+}
+
+// builds a room hash that the HMAC verifier will accept
+func (verifier *HMACHashVerifier) Sign(roomID string) string {
+	mac := hmac.New(sha256.New, verifier.secret)
+	mac.Write([]byte(roomID))
+	return roomID + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (verifier *HMACHashVerifier) Verify(hash string) (bool, error) {
+	roomID, signature, found := strings.Cut(hash, ".")
+	if !found || roomID == "" {
+		return false, nil
+	}
+
+	given, err := hex.DecodeString(signature)
+	if err != nil {
+		return false, nil
+	}
+
+	mac := hmac.New(sha256.New, verifier.secret)
+	mac.Write([]byte(roomID))
+	return hmac.Equal(given, mac.Sum(nil)), nil
+}
+
+func (verifier AllowAllHashVerifier) Verify(hash string) (bool, error) {
+	return hash != "", nil
+}
+
+func (verifier *CachingHashVerifier) Verify(hash string) (bool, error) {
+	now := time.Now()
+
+	verifier.mutex.Lock()
+	entry, found := verifier.entries[hash]
+	verifier.mutex.Unlock()
+
+	if found && now.Before(entry.expiresAt) {
+		return entry.ok, nil
+	}
+
+	ok, err := verifier.verifier.Verify(hash)
+	if err != nil {
+		// errors are not cached so the next attempt retries upstream
+		return false, err
+	}
+
+	verifier.mutex.Lock()
+	if len(verifier.entries) >= maxCachedVerifications {
+		for key, cached := range verifier.entries {
+			if now.After(cached.expiresAt) {
+				delete(verifier.entries, key)
+			}
+		}
+	}
+	verifier.entries[hash] = cachedVerification{ok: ok, expiresAt: now.Add(verifier.ttl)}
+	verifier.mutex.Unlock()
+
+	return ok, nil
+}
+
+// picks the hash verifier from HASH_VERIFIER ("remote", "hmac" or "allow_all")
+func NewHashVerifierFromEnv() (HashVerifier, error) {
+	switch os.Getenv("HASH_VERIFIER") {
+	case "", "remote":
+		ttl := 60 * time.Second
+		if value := os.Getenv("HASH_VERIFY_CACHE_TTL_SECONDS"); value != "" {
+			seconds, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid HASH_VERIFY_CACHE_TTL_SECONDS: %w", err)
+			}
+			ttl = time.Duration(seconds) * time.Second
+		}
+
+		remote := NewRemoteHashVerifier(API_BASE_URL)
+		if ttl <= 0 {
+			return remote, nil
+		}
+		return NewCachingHashVerifier(remote, ttl), nil
+	case "hmac":
+		secret := os.Getenv("HASH_VERIFIER_SECRET")
+		if secret == "" {
+			return nil, errors.New("HASH_VERIFIER_SECRET is required for the hmac hash verifier")
+		}
+		return NewHMACHashVerifier(secret), nil
+	case "allow_all":
+		return AllowAllHashVerifier{}, nil
+	default:
+		return nil, fmt.Errorf("unknown HASH_VERIFIER: %s", os.Getenv("HASH_VERIFIER"))
+	}
+}
+
+const issuedRoomTTL = 1 * time.Hour
+
+// rooms issued while running without redis, with when they expire
+var localIssuedRooms = make(map[string]time.Time)
+var localIssuedRoomsMutex sync.Mutex
+
+func issuedRoomKey(hash string) string {
+	return "geofinder:issued_room:" + hash
+}
+
+// mints a room hash on the server itself (matchmaking, rematches), these skip the
+// hash verifier since the geo api never signed them
+func IssueRoomHash(prefix string) string {
+	hash := prefix + uuid.NewString()
+
+	if redisClient == nil {
+		localIssuedRoomsMutex.Lock()
+		localIssuedRooms[hash] = time.Now().Add(issuedRoomTTL)
+		localIssuedRoomsMutex.Unlock()
+		return hash
+	}
+
+	ctx := context.Background()
+	if err := redisClient.Set(ctx, issuedRoomKey(hash), nodeID, issuedRoomTTL).Err(); err != nil {
+		LogRedisError("issue_room", err)
+	}
+	return hash
+}
+
+func IsIssuedRoom(hash string) bool {
+	if redisClient == nil {
+		localIssuedRoomsMutex.Lock()
+		defer localIssuedRoomsMutex.Unlock()
+
+		expires, found := localIssuedRooms[hash]
+		if found && time.Now().After(expires) {
+			delete(localIssuedRooms, hash)
+			return false
+		}
+		return found
+	}
+
+	ctx := context.Background()
+	exists, err := redisClient.Exists(ctx, issuedRoomKey(hash)).Result()
+	return err == nil && exists == 1
+}
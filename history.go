@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+const DefaultHistoryLimit int = 20
+const MaxHistoryLimit int = 100
+
+// records and player indexes expire once nobody has played for this long
+const historyTTL = 90 * 24 * time.Hour
+
+// keeps finished matches around after cleanupFinishedMatches drops them from memory
+type MatchHistoryRepository interface {
+	SaveMatch(record MatchHistoryRecord) error
+	// newest first
+	AccountMatches(accountID string, limit int) ([]MatchHistoryRecord, error)
+}
+
+// appends one JSON record per line to a local file
+type FileMatchHistoryRepository struct {
+	Path  string
+	mutex sync.Mutex
+}
+
+// stores records as JSON with a sorted set of record ids per account
+type RedisMatchHistoryRepository struct {
+	Client *redis.Client
+}
+
+func NewFileMatchHistoryRepository(path string) *FileMatchHistoryRepository {
+	return &FileMatchHistoryRepository{Path: path}
+}
+
+func NewRedisMatchHistoryRepository(client *redis.Client) *RedisMatchHistoryRepository {
+	return &RedisMatchHistoryRepository{Client: client}
+}
+
+func (repo *FileMatchHistoryRepository) SaveMatch(record MatchHistoryRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	file, err := os.OpenFile(repo.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func (repo *FileMatchHistoryRepository) AccountMatches(accountID string, limit int) ([]MatchHistoryRecord, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	file, err := os.Open(repo.Path)
+	if os.IsNotExist(err) {
+		return []MatchHistoryRecord{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// records are appended in finish order, so the last matches are the newest
+	records := make([]MatchHistoryRecord, 0, limit)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var record MatchHistoryRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		if !slices.Contains(record.AccountIDs, accountID) {
+			continue
+		}
+		if len(records) == limit {
+			records = records[1:]
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	slices.Reverse(records)
+	return records, nil
+}
+
+func historyRecordKey(id string) string {
+	return "geofinder:history:match:" + id
+}
+
+func historyAccountKey(accountID string) string {
+	return "geofinder:history:account:" + accountID
+}
+
+func (repo *RedisMatchHistoryRepository) SaveMatch(record MatchHistoryRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	_, err = repo.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, historyRecordKey(record.ID), data, historyTTL)
+		for _, accountID := range record.AccountIDs {
+			key := historyAccountKey(accountID)
+			pipe.ZAdd(ctx, key, redis.Z{
+				Score:  float64(record.FinishedAt.UnixMilli()),
+				Member: record.ID,
+			})
+			// only the newest MaxHistoryLimit matches are reachable per account
+			pipe.ZRemRangeByRank(ctx, key, 0, int64(-MaxHistoryLimit-1))
+			pipe.Expire(ctx, key, historyTTL)
+		}
+		return nil
+	})
+	return err
+}
+
+func (repo *RedisMatchHistoryRepository) AccountMatches(accountID string, limit int) ([]MatchHistoryRecord, error) {
+	ctx := context.Background()
+	ids, err := repo.Client.ZRevRange(ctx, historyAccountKey(accountID), 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]MatchHistoryRecord, 0, len(ids))
+	if len(ids) == 0 {
+		return records, nil
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = historyRecordKey(id)
+	}
+	values, err := repo.Client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var record MatchHistoryRecord
+		if err := json.Unmarshal([]byte(data), &record); err != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// picks the history store from MATCH_HISTORY ("redis", "file" or "none")
+func NewMatchHistoryRepositoryFromEnv() (MatchHistoryRepository, error) {
+	switch os.Getenv("MATCH_HISTORY") {
+	case "", "redis":
+		if redisClient == nil && os.Getenv("MATCH_HISTORY") == "" {
+			// a single node without redis has nowhere to keep history unless told to use a file
+			return nil, nil
+		}
+		if redisClient == nil {
+			return nil, fmt.Errorf("redis is required for the redis match history")
+		}
+		return NewRedisMatchHistoryRepository(redisClient), nil
+	case "file":
+		path := os.Getenv("MATCH_HISTORY_PATH")
+		if path == "" {
+			path = "match_history.jsonl"
+		}
+		return NewFileMatchHistoryRepository(path), nil
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown MATCH_HISTORY: %s", os.Getenv("MATCH_HISTORY"))
+	}
+}
+
+// copies rounds down to the answers, the copy is written out after the match lock is released
+func cloneRounds(rounds []Round) []Round {
+	cloned := make([]Round, len(rounds))
+	for i, round := range rounds {
+		round.HostGuess = cloneAnswer(round.HostGuess)
+		round.GuestGuess = cloneAnswer(round.GuestGuess)
+		if round.Guesses != nil {
+			guesses := make(map[string]*PlayerAnswer, len(round.Guesses))
+			for id, guess := range round.Guesses {
+				guesses[id] = cloneAnswer(guess)
+			}
+			round.Guesses = guesses
+		}
+		cloned[i] = round
+	}
+	return cloned
+}
+
+func cloneAnswer(answer *PlayerAnswer) *PlayerAnswer {
+	if answer == nil {
+		return nil
+	}
+	cloned := *answer
+	if answer.Pin != nil {
+		pin := *answer.Pin
+		cloned.Pin = &pin
+	}
+	if answer.Distance != nil {
+		distance := *answer.Distance
+		cloned.Distance = &distance
+	}
+	return &cloned
+}
+
+// snapshots a finished match and writes it to the history store in the background
+func recordMatchHistory(match *Match, gameEnd GameEndPayload) {
+	if matchHistory == nil {
+		return
+	}
+
+	match.mutex.RLock()
+	if match.GameState.CurrentRound == 0 {
+		match.mutex.RUnlock()
+		return
+	}
+
+	record := MatchHistoryRecord{
+		ID:         uuid.NewString(),
+		Hash:       match.Hash,
+		Mode:       match.Config.Mode,
+		Config:     match.Config,
+		HostID:     match.HostID,
+		GuestID:    match.GuestID,
+		Rounds:     cloneRounds(match.GameState.Rounds[:match.GameState.CurrentRound]),
+		HostScore:  gameEnd.HostScore,
+		GuestScore: gameEnd.GuestScore,
+		Scores:     maps.Clone(match.GameState.Scores),
+		TeamScores: gameEnd.TeamScores,
+		Winner:     gameEnd.Winner,
+		Standings:  gameEnd.Standings,
+		CreatedAt:  match.CreatedAt,
+		FinishedAt: time.Now(),
+	}
+	for _, id := range []string{match.HostID, match.GuestID} {
+		if id != "" {
+			record.PlayerIDs = append(record.PlayerIDs, id)
+		}
+	}
+	for id := range match.Players {
+		record.PlayerIDs = append(record.PlayerIDs, id)
+	}
+	// player ids only last one match, the account is what a player keeps
+	for _, id := range record.PlayerIDs {
+		if accountID := match.Accounts[id]; accountID != "" && !slices.Contains(record.AccountIDs, accountID) {
+			record.AccountIDs = append(record.AccountIDs, accountID)
+		}
+	}
+	match.mutex.RUnlock()
+
+	go func() {
+		if err := matchHistory.SaveMatch(record); err != nil {
+			LogWithFields(logrus.Fields{
+				"event":     "match_history_error",
+				"room_hash": record.Hash,
+				"error":     err.Error(),
+			}).Error("Failed to save match history")
+			return
+		}
+		LogMatchLifecycle(record.Hash, "history_saved", logrus.Fields{
+			"history_id": record.ID,
+		})
+	}()
+}
+
+func handleAccountHistory(c *fiber.Ctx) error {
+	if matchHistory == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Match history disabled"})
+	}
+
+	limit := DefaultHistoryLimit
+	if n, err := strconv.Atoi(c.Query("limit")); err == nil {
+		limit = max(1, min(n, MaxHistoryLimit))
+	}
+
+	// records name everyone in the match, so only the account's own identity can list them
+	accountID := c.Params("accountId")
+	if verified, ok := VerifyIdentity(bearerToken(c)); !ok || verified != accountID {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Invalid token"})
+	}
+
+	records, err := matchHistory.AccountMatches(accountID, limit)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{
+		"accountId": accountID,
+		"matches":   records,
+	})
+}
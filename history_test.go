@@ -0,0 +1,79 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRecordMatchHistoryAccounts(t *testing.T) {
+	tests := []struct {
+		name     string
+		accounts map[string]string
+		want     []string
+	}{
+		{"one account each", map[string]string{"host": "a", "guest": "b"}, []string{"a", "b"}},
+		{"same account in both seats", map[string]string{"host": "a", "guest": "a"}, []string{"a"}},
+		{"seat without an account", map[string]string{"host": "a"}, []string{"a"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			history := &recordedHistory{saved: make(chan MatchHistoryRecord, 1)}
+			matchHistory = history
+			t.Cleanup(func() { matchHistory = nil })
+
+			match := newPlayingMatch(NewMatchStore(), "room")
+			match.Accounts = test.accounts
+			recordMatchHistory(match, GameEndPayload{Winner: "host"})
+
+			select {
+			case record := <-history.saved:
+				if !slices.Equal(record.AccountIDs, test.want) {
+					t.Errorf("accountIds = %v, want %v", record.AccountIDs, test.want)
+				}
+				if !slices.Equal(record.PlayerIDs, []string{"host", "guest"}) {
+					t.Errorf("playerIds = %v, want the seats", record.PlayerIDs)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("no history record saved")
+			}
+		})
+	}
+}
+
+func TestFileAccountMatches(t *testing.T) {
+	repo := NewFileMatchHistoryRepository(filepath.Join(t.TempDir(), "history.jsonl"))
+	for i, accounts := range [][]string{{"a", "b"}, {"b", "c"}, {"a", "c"}} {
+		record := MatchHistoryRecord{ID: strconv.Itoa(i + 1), AccountIDs: accounts}
+		if err := repo.SaveMatch(record); err != nil {
+			t.Fatalf("SaveMatch() error: %v", err)
+		}
+	}
+
+	tests := []struct {
+		accountID string
+		limit     int
+		want      []string // record ids, newest first
+	}{
+		{"a", 10, []string{"3", "1"}},
+		{"b", 10, []string{"2", "1"}},
+		{"c", 1, []string{"3"}},
+		{"d", 10, nil},
+	}
+	for _, test := range tests {
+		records, err := repo.AccountMatches(test.accountID, test.limit)
+		if err != nil {
+			t.Fatalf("AccountMatches(%s) error: %v", test.accountID, err)
+		}
+		var ids []string
+		for _, record := range records {
+			ids = append(ids, record.ID)
+		}
+		if !slices.Equal(ids, test.want) {
+			t.Errorf("AccountMatches(%s, %d) = %v, want %v", test.accountID, test.limit, ids, test.want)
+		}
+	}
+}
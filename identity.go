@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// signs account ids so clients can't claim someone else's rating
+var identitySigner *HMACHashVerifier
+
+// reads IDENTITY_SECRET, which every node has to share so identities and
+// reconnect tokens signed on one node are accepted on the others, without it
+// a per-process secret is used and they only hold on this node until it restarts
+func InitIdentity() {
+	secret := os.Getenv("IDENTITY_SECRET")
+	if secret == "" {
+		random := make([]byte, 32)
+		rand.Read(random)
+		secret = fmt.Sprintf("%x", random)
+		LogWithFields(logrus.Fields{
+			"event": "identity_secret_missing",
+		}).Warn("IDENTITY_SECRET not set, identities and reconnect tokens will not verify on other nodes or after a restart")
+	}
+	identitySigner = NewHMACHashVerifier(secret)
+}
+
+// the token of an Authorization: Bearer header
+func bearerToken(c *fiber.Ctx) string {
+	return strings.TrimPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+}
+
+// the account id inside a signed identity token
+func VerifyIdentity(token string) (string, bool) {
+	if ok, _ := identitySigner.Verify(token); !ok {
+		return "", false
+	}
+	accountID, _, _ := strings.Cut(token, ".")
+	return accountID, true
+}
+
+// the account id for a token sent on auth, or a fresh account if it is missing or forged
+func ResolveIdentity(token string) string {
+	if accountID, ok := VerifyIdentity(token); ok {
+		return accountID
+	}
+	return uuid.NewString()
+}
+
+func IdentityToken(accountID string) string {
+	return identitySigner.Sign(accountID)
+}
+
+// player ids are shown to the whole room, so taking a seat back needs this
+// token too, it is derived from the id so rematches and other nodes accept it
+func ReconnectToken(playerID string) string {
+	return strings.TrimPrefix(identitySigner.Sign("seat:"+playerID), "seat:"+playerID+".")
+}
+
+func ValidReconnectToken(playerID string, token string) bool {
+	return playerID != "" && hmac.Equal([]byte(ReconnectToken(playerID)), []byte(token))
+}
+
+// ties a player id in the match to an account, keeping the first account bound
+func (store *MatchStore) BindAccount(hash string, playerID string, accountID string) (string, error) {
+	match, exists := store.GetMatch(hash)
+	if !exists {
+		return "", fmt.Errorf("Match %s not found", hash)
+	}
+
+	match.mutex.Lock()
+	defer match.mutex.Unlock()
+
+	if match.Accounts == nil {
+		match.Accounts = make(map[string]string)
+	}
+	if bound, found := match.Accounts[playerID]; found {
+		return bound, nil
+	}
+	match.Accounts[playerID] = accountID
+	return accountID, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ImageProvider interface {
+	GetImage() (ImageResponse, error)
+}
+
+// fetches images from the geo api
+type HTTPImageProvider struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+// serves a fixed list of images in order, looping back to the start
+type MemoryImageProvider struct {
+	mutex  sync.Mutex
+	images []ImageResponse
+	next   int
+}
+
+func NewHTTPImageProvider(baseURL string) *HTTPImageProvider {
+	return &HTTPImageProvider{
+		BaseURL: baseURL,
+		Client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func NewMemoryImageProvider(images ...ImageResponse) *MemoryImageProvider {
+	return &MemoryImageProvider{images: images}
+}
+
+// loads fixtures from a JSON array or a JSONL file into a memory provider
+func NewFileImageProvider(path string) (*MemoryImageProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var images []ImageResponse
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "[") {
+		if err := json.Unmarshal(data, &images); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	} else {
+		scanner := bufio.NewScanner(strings.NewReader(string(data)))
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		line := 0
+		for scanner.Scan() {
+			line++
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" {
+				continue
+			}
+			var image ImageResponse
+			if err := json.Unmarshal([]byte(text), &image); err != nil {
+				return nil, fmt.Errorf("failed to parse %s line %d: %w", path, line, err)
+			}
+			images = append(images, image)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(images) == 0 {
+		return nil, fmt.Errorf("no images in %s", path)
+	}
+	return NewMemoryImageProvider(images...), nil
+}
+
+func (provider *MemoryImageProvider) GetImage() (ImageResponse, error) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	if len(provider.images) == 0 {
+		return ImageResponse{}, errors.New("memory image provider is empty")
+	}
+
+	image := provider.images[provider.next%len(provider.images)]
+	provider.next++
+	return image, nil
+}
+
+// picks the image provider from IMAGE_PROVIDER ("http", "file" or "memory")
+func NewImageProviderFromEnv() (ImageProvider, error) {
+	switch os.Getenv("IMAGE_PROVIDER") {
+	case "", "http":
+		baseURL := os.Getenv("IMAGE_API_BASE_URL")
+		if baseURL == "" {
+			baseURL = API_BASE_URL
+		}
+		return NewHTTPImageProvider(baseURL), nil
+	case "file":
+		path := os.Getenv("IMAGE_FIXTURE_PATH")
+		if path == "" {
+			return nil, errors.New("IMAGE_FIXTURE_PATH is required for the file image provider")
+		}
+		return NewFileImageProvider(path)
+	case "memory":
+		return NewMemoryImageProvider(ImageResponse{
+			ImageURL:    "https://example.com/fixture.jpg",
+			Coordinates: Coordinates{Lat: 48.8584, Lon: 2.2945},
+			CountryName: "France",
+			CountryCode: "FR",
+			Contributor: "fixture",
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown IMAGE_PROVIDER: %s", os.Getenv("IMAGE_PROVIDER"))
+	}
+}
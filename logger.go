@@ -120,6 +120,7 @@ func LogBroadcastEvent(hash string, messageType string, recipientCount int) {
 }
 
 func LogBroadcastError(hash string, role string, err error) {
+	broadcastErrors.WithLabelValues(role).Inc()
 	LogWithFields(logrus.Fields{
 		"event":     "broadcast_error",
 		"room_hash": hash,
@@ -152,3 +153,40 @@ func LogMatchLifecycle(hash string, lifecycleEvent string, details logrus.Fields
 	}
 	LogWithFields(baseFields).Info("Match lifecycle event")
 }
+
+func LogClusterEvent(hash string, clusterEvent string, details logrus.Fields) {
+	baseFields := logrus.Fields{
+		"event":         "cluster",
+		"room_hash":     hash,
+		"node_id":       nodeID,
+		"cluster_event": clusterEvent,
+	}
+	for k, v := range details {
+		baseFields[k] = v
+	}
+	LogWithFields(baseFields).Info("Cluster event")
+}
+
+func LogAdminAction(hash string, action string, details logrus.Fields) {
+	baseFields := logrus.Fields{
+		"event":        "admin_action",
+		"room_hash":    hash,
+		"admin_action": action,
+	}
+	for k, v := range details {
+		baseFields[k] = v
+	}
+	LogWithFields(baseFields).Warn("Admin action")
+}
+
+func LogTournamentEvent(tournamentID string, tournamentEvent string, details logrus.Fields) {
+	baseFields := logrus.Fields{
+		"event":            "tournament",
+		"tournament_id":    tournamentID,
+		"tournament_event": tournamentEvent,
+	}
+	for k, v := range details {
+		baseFields[k] = v
+	}
+	LogWithFields(baseFields).Info("Tournament event")
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
+	"os/signal"
 	"runtime"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -14,7 +16,11 @@ import (
 )
 
 var matchStore *MatchStore
-var discoveryConnections []*websocket.Conn
+var imageProvider ImageProvider
+var hashVerifier HashVerifier
+var matchHistory MatchHistoryRepository
+var ratingRepository RatingRepository
+var discoveryConnections []*DiscoverySubscriber
 var discoveryMutex sync.RWMutex
 
 func cleanupFinishedMatches() {
@@ -24,7 +30,7 @@ func cleanupFinishedMatches() {
 	for range ticker.C {
 		matchStore.mutex.RLock()
 		for hash, match := range matchStore.matches {
-			if match.State == "finished" {
+			if match.CurrentState() == "finished" {
 				if time.Since(match.CreatedAt) > 10*time.Minute {
 					LogMatchLifecycle(hash, "cleanup", logrus.Fields{
 						"match_age_seconds": int64(time.Since(match.CreatedAt).Seconds()),
@@ -39,31 +45,59 @@ func cleanupFinishedMatches() {
 
 func handleGameConnection(c *websocket.Conn, router *EventRouter) {
 	hash := c.Query("roomHash")
+	codeHash := ""
+	if c.Query("joinCode") != "" {
+		codeHash = LookupJoinCode(c.Query("joinCode"))
+	}
+	if hash == "" {
+		hash = codeHash
+	}
+	provenCode := codeHash != "" && codeHash == hash
 	if hash == "" {
 		c.WriteJSON(map[string]interface{}{"error": "Missing roomHash"})
 		return
 	}
 
-	hashRes, err := VerifyHash(hash)
-	if err != nil || !hashRes.Ok {
+	var err error
+	ok := IsIssuedRoom(hash)
+	if !ok {
+		ok, err = hashVerifier.Verify(hash)
+	}
+	if err != nil || !ok {
 		c.WriteJSON(map[string]interface{}{"error": "Invalid room hash"})
 		return
 	}
 
-	match, _ := matchStore.GetMatch(hash)
-	if match == nil {
-		match = matchStore.CreateMatch(hash)
+	activeGameConnections.Add(1)
+	defer activeGameConnections.Add(-1)
+
+	config := ParseMatchConfig(c)
+
+	owner, err := ClaimMatchOwnership(hash)
+	if err == nil && owner != nodeID {
+		if relayGameConnection(c, hash, owner, config, provenCode) != errOwnerNotListening {
+			return
+		}
+		// the owner holds the key but nobody answered, serve the room here
+		if !TakeOverMatchOwnership(hash, owner) {
+			c.WriteJSON(map[string]interface{}{"error": "Room unavailable"})
+			return
+		}
 	}
 
-	LogWebSocketConnection(hash, "", "", true)
+	created := openMatch(hash, config)
 
-	var connectionRole string
+	LogWebSocketConnection(hash, "", "", true)
 
-	defer func() {
-		if connectionRole != "" {
-			matchStore.RemoveConnection(hash, connectionRole)
-		}
-	}()
+	session := &GameSession{
+		Hash:   hash,
+		Conn:   NewProtocolConn(c),
+		Router: router,
+	}
+	if created || provenCode {
+		session.Conn.Admit()
+	}
+	defer session.Close()
 
 	for {
 		messageType, data, err := c.ReadMessage()
@@ -71,68 +105,8 @@ func handleGameConnection(c *websocket.Conn, router *EventRouter) {
 			break
 		}
 
-		if messageType != websocket.TextMessage {
-			continue
-		}
-
-		var message struct {
-			Event string      `json:"event"`
-			Data  interface{} `json:"data"`
-		}
-		if err := json.Unmarshal(data, &message); err != nil {
-			continue
-		}
-
-		if message.Event == "auth" {
-			dataMap := message.Data.(map[string]interface{})
-			if playerID, ok := dataMap["playerID"].(string); ok {
-				if match.HostID == playerID {
-					connectionRole = "host"
-				} else if match.GuestID == playerID {
-					connectionRole = "guest"
-				}
-			}
-		}
-
-		dataMap := message.Data.(map[string]interface{})
-		dataMap["hash"] = hash
-
-		router.Handle(c, message.Event, dataMap)
+		session.HandleFrame(messageType, data)
 	}
-
-}
-
-func handleDiscoveryConnection(c *websocket.Conn) {
-	// Add to discovery connections
-	discoveryMutex.Lock()
-	discoveryConnections = append(discoveryConnections, c)
-	discoveryMutex.Unlock()
-	LogDiscoveryConnection(true, len(discoveryConnections))
-
-	// Send initial waiting rooms
-	rooms := matchStore.GetWaitingRooms()
-	c.WriteJSON(map[string]interface{}{
-		"type": "rooms_list",
-		"data": rooms,
-	})
-
-	// Handle disconnection
-	go func() {
-		for {
-			if _, _, err := c.ReadMessage(); err != nil {
-				discoveryMutex.Lock()
-				for i, conn := range discoveryConnections {
-					if conn == c {
-						discoveryConnections = append(discoveryConnections[:i], discoveryConnections[i+1:]...)
-						LogDiscoveryConnection(false, len(discoveryConnections))
-						break
-					}
-				}
-				discoveryMutex.Unlock()
-				break
-			}
-		}
-	}()
 }
 
 func roundTimeoutChecker(ctx context.Context, hash string) {
@@ -152,6 +126,7 @@ func roundTimeoutChecker(ctx context.Context, hash string) {
 			match.mutex.RLock()
 			matchState := match.State
 			currentRound := match.GameState.CurrentRound
+			roundCount := len(match.GameState.Rounds)
 			match.mutex.RUnlock()
 
 			if matchState != "playing" {
@@ -159,7 +134,7 @@ func roundTimeoutChecker(ctx context.Context, hash string) {
 			}
 
 			roundNum := currentRound - 1
-			if roundNum < 0 || roundNum >= 5 {
+			if roundNum < 0 || roundNum >= roundCount {
 				return
 			}
 
@@ -178,54 +153,288 @@ func roundTimeoutChecker(ctx context.Context, hash string) {
 						return
 					}
 
-					matchStore.BroadcastToRoom(hash, result)
+					advanceMatch(hash, result)
+				}
+			}
+		}
+	}
+}
 
-					match, _ := matchStore.GetMatch(hash)
+// waits for the prefetch, then moves a waiting match to playing and starts round 1
+func startMatch(conn Connection, hash string) {
+	match, exists := matchStore.GetMatch(hash)
+	if !exists {
+		return
+	}
 
-					match.mutex.RLock()
-					currentRound := match.GameState.CurrentRound
-					hostScore := match.GameState.HostScore
-					guestScore := match.GameState.GuestScore
-					match.mutex.RUnlock()
+	select {
+	case <-match.ReadyChan:
+		playerCount := GetPlayerCount(match)
 
-					if currentRound < 5 {
-						time.AfterFunc(3*time.Second, func() {
-							matchStore.StartNextRound(hash)
-						})
-					} else {
-						gameEnd := GameEndPayload{
-							Type:       "game_end",
-							HostScore:  hostScore,
-							GuestScore: guestScore,
-							Winner:     GetWinner(hostScore, guestScore),
-						}
-						matchStore.BroadcastToRoom(hash, gameEnd)
-
-						match.mutex.Lock()
-						match.State = "finished"
-						match.mutex.Unlock()
-
-						PublishRoomState(hash, "finished", 2)
-					}
-				}
-			}
+		match.mutex.Lock()
+		if match.State != "waiting" {
+			LogMatchEvent(hash, "game_already_started", logrus.Fields{
+				"current_state": match.State,
+			})
+			match.mutex.Unlock()
+			return
 		}
+		match.State = "playing"
+		LogMatchEvent(hash, "game_started", logrus.Fields{
+			"player_count": playerCount,
+		})
+		match.mutex.Unlock()
+		PublishRoomState(match)
+		matchStore.SaveMatch(hash)
+
+		err := matchStore.StartNextRound(hash)
+		if err != nil {
+			LogGameRound(hash, 1, "start_error", logrus.Fields{
+				"error": err.Error(),
+			})
+		} else {
+			go roundTimeoutChecker(context.Background(), hash)
+		}
+	case <-time.After(match.Config.ReadyTimeout()):
+		matchesTimedOut.Inc()
+		LogMatchEvent(hash, "game_ready_timeout", logrus.Fields{})
+		conn.WriteJSON(map[string]interface{}{
+			"type":    "error",
+			"message": "Game initialization timeout",
+		})
 	}
 }
 
+// broadcasts a round result, then either schedules the next round after the
+// intermission or ends the game if that was the last round
+func advanceMatch(hash string, result *RoundResultPayload) {
+	matchStore.BroadcastToRoom(hash, result)
+
+	match, exists := matchStore.GetMatch(hash)
+	if !exists {
+		return
+	}
+
+	match.mutex.RLock()
+	currentRound := match.GameState.CurrentRound
+	roundCount := len(match.GameState.Rounds)
+	intermission := match.Config.Intermission()
+	match.mutex.RUnlock()
+
+	if currentRound < roundCount {
+		time.AfterFunc(intermission, func() {
+			matchStore.StartNextRound(hash)
+		})
+		return
+	}
+
+	finishMatch(hash, false)
+}
+
+// marks the match finished and broadcasts game_end, only the first call for a
+// match does anything so a late answer or timer can't end it twice, a match an
+// admin ended early counts for nothing, no rating, series, history or bracket
+func finishMatch(hash string, forced bool) bool {
+	match, exists := matchStore.GetMatch(hash)
+	if !exists {
+		return false
+	}
+
+	match.mutex.Lock()
+	if match.State == "finished" {
+		match.mutex.Unlock()
+		return false
+	}
+	match.State = "finished"
+	match.mutex.Unlock()
+
+	match.mutex.RLock()
+	hostScore := match.GameState.HostScore
+	guestScore := match.GameState.GuestScore
+	match.mutex.RUnlock()
+
+	gameEnd := GameEndPayload{
+		Type:       "game_end",
+		HostScore:  hostScore,
+		GuestScore: guestScore,
+		Winner:     GetWinner(hostScore, guestScore),
+	}
+	if match.IsMultiplayer() {
+		gameEnd.Standings = GetStandings(match)
+		gameEnd.Winner = GetStandingsWinner(gameEnd.Standings)
+	}
+	if match.IsTeams() {
+		match.mutex.RLock()
+		gameEnd.TeamScores = make(map[string]int)
+		for team, score := range match.GameState.TeamScores {
+			gameEnd.TeamScores[team] = score
+		}
+		match.mutex.RUnlock()
+		gameEnd.Winner = GetTeamWinner(gameEnd.TeamScores)
+	}
+	if !forced {
+		gameEnd.RatingChanges = UpdateRatings(match, gameEnd)
+		gameEnd.Series = recordSeriesResult(match, gameEnd.Winner)
+	}
+	matchStore.BroadcastToRoom(hash, gameEnd)
+
+	matchStore.SaveMatch(hash)
+	matchesFinished.Inc()
+	if !forced {
+		recordMatchHistory(match, gameEnd)
+		AdvanceTournament(match, gameEnd.Winner)
+	}
+
+	PublishRoomState(match)
+	return true
+}
+
+// creates the match on first connect, true if this call created it
+func openMatch(hash string, config MatchConfig) bool {
+	if _, exists := findMatch(hash); exists {
+		return false
+	}
+
+	matchStore.CreateMatch(hash, config)
+	return true
+}
+
+// finds a match in memory, or rehydrates it from redis and picks the game back up
+func findMatch(hash string) (*Match, bool) {
+	if match, exists := matchStore.GetMatch(hash); exists {
+		return match, true
+	}
+
+	match := matchStore.RestoreMatch(hash)
+	if match == nil {
+		return matchStore.GetMatch(hash)
+	}
+
+	resumeMatch(hash)
+	return match, true
+}
+
+// restarts the round timer of a restored match and whatever was pending when it was snapshotted
+func resumeMatch(hash string) {
+	match, exists := matchStore.GetMatch(hash)
+	if !exists {
+		return
+	}
+
+	match.mutex.RLock()
+	state := match.State
+	currentRound := match.GameState.CurrentRound
+	roundCount := len(match.GameState.Rounds)
+	roundFinished := currentRound > 0 && currentRound <= roundCount && match.GameState.Rounds[currentRound-1].Finished
+	intermission := match.Config.Intermission()
+	match.mutex.RUnlock()
+
+	if state != "playing" {
+		return
+	}
+
+	LogMatchEvent(hash, "game_resumed", logrus.Fields{
+		"current_round":  currentRound,
+		"round_finished": roundFinished,
+	})
+
+	switch {
+	case currentRound == 0:
+		matchStore.StartNextRound(hash)
+	case roundFinished && currentRound < roundCount:
+		time.AfterFunc(intermission, func() {
+			matchStore.StartNextRound(hash)
+		})
+	case roundFinished:
+		finishMatch(hash, false)
+		return
+	}
+
+	go roundTimeoutChecker(context.Background(), hash)
+}
+
 func main() {
 	matchStore = NewMatchStore()
 
+	provider, err := NewImageProviderFromEnv()
+	if err != nil {
+		LogWithFields(logrus.Fields{
+			"event": "image_provider_error",
+			"error": err.Error(),
+		}).Fatal("Failed to configure image provider")
+	}
+	imageProvider = provider
+	LogWithFields(logrus.Fields{
+		"event":    "image_provider_configured",
+		"provider": fmt.Sprintf("%T", provider),
+	}).Info("Image provider configured")
+
+	verifier, err := NewHashVerifierFromEnv()
+	if err != nil {
+		LogWithFields(logrus.Fields{
+			"event": "hash_verifier_error",
+			"error": err.Error(),
+		}).Fatal("Failed to configure hash verifier")
+	}
+	hashVerifier = verifier
+	LogWithFields(logrus.Fields{
+		"event":    "hash_verifier_configured",
+		"verifier": fmt.Sprintf("%T", verifier),
+	}).Info("Hash verifier configured")
+
 	if err := InitRedis(); err != nil {
 		LogRedisError("init", err)
 	}
 
-	go func() {
-		ctx := context.Background()
-		SubscribeToRoomUpdates(ctx)
-	}()
+	history, err := NewMatchHistoryRepositoryFromEnv()
+	if err != nil {
+		LogWithFields(logrus.Fields{
+			"event": "match_history_error",
+			"error": err.Error(),
+		}).Fatal("Failed to configure match history")
+	}
+	matchHistory = history
+	LogWithFields(logrus.Fields{
+		"event":      "match_history_configured",
+		"repository": fmt.Sprintf("%T", history),
+	}).Info("Match history configured")
+
+	ratings, err := NewRatingRepositoryFromEnv()
+	if err != nil {
+		LogWithFields(logrus.Fields{
+			"event": "ratings_error",
+			"error": err.Error(),
+		}).Fatal("Failed to configure ratings")
+	}
+	ratingRepository = ratings
+	LogWithFields(logrus.Fields{
+		"event":      "ratings_configured",
+		"repository": fmt.Sprintf("%T", ratings),
+	}).Info("Ratings configured")
+
+	InitIdentity()
+
+	// a single node without redis hands these out itself
+	if redisClient != nil {
+		go func() {
+			ctx := context.Background()
+			SubscribeToRoomUpdates(ctx)
+		}()
+
+		go func() {
+			ctx := context.Background()
+			SubscribeToTournamentUpdates(ctx)
+		}()
+
+		go func() {
+			ctx := context.Background()
+			SubscribeToMatchmaking(ctx)
+		}()
+	}
 
 	go cleanupFinishedMatches()
+	go runMatchmaker()
+	go maintainMatchOwnership()
 
 	app := fiber.New()
 	app.Use(cors.New(cors.Config{
@@ -236,189 +445,264 @@ func main() {
 
 	eventRouter := NewEventRouter()
 
-	eventRouter.On("ping", func(conn *websocket.Conn, data interface{}) {
-		conn.WriteMessage(websocket.TextMessage, []byte("pong"))
-	})
-
-	eventRouter.On("auth", func(conn *websocket.Conn, data interface{}) {
-		dataMap, ok := data.(map[string]interface{})
-		if !ok {
-			conn.WriteJSON(map[string]interface{}{"type": "error", "message": "invalid payload"})
-			return
-		}
+	if redisClient != nil {
+		go func() {
+			ctx := context.Background()
+			SubscribeToRelayedConnections(ctx, eventRouter)
+		}()
+	}
 
-		hash, _ := dataMap["hash"].(string)
-		if hash == "" {
-			conn.WriteJSON(map[string]interface{}{"type": "error", "message": "Missing hash"})
-			return
-		}
+	eventRouter.On("ping", Handle(func(conn Connection, hash string, payload *EmptyRequest) *ProtocolError {
+		conn.WriteMessage(websocket.TextMessage, []byte("pong"))
+		return nil
+	}))
 
-		playerID, _ := dataMap["playerID"].(string)
+	eventRouter.On("auth", Handle(func(conn Connection, hash string, payload *AuthRequest) *ProtocolError {
+		playerID := payload.PlayerID
 
-		match, exists := matchStore.GetMatch(hash)
+		match, exists := findMatch(hash)
 		if !exists {
-			conn.WriteJSON(map[string]interface{}{
-				"type":    "error",
-				"message": "Match not found",
-			})
-			return
+			return NewProtocolError(ErrMatchNotFound, "Match not found")
 		}
 		var role string
+		seat := 0
+		team := ""
 
 		if playerID == "" {
-			if match.HostConn == nil {
-				role = "host"
-				id, _ := GeneratePlayerID()
-				matchStore.SetConnection(hash, id, role, conn)
-				playerID = id
-			} else if match.GuestConn == nil {
-				role = "guest"
-				id, _ := GeneratePlayerID()
-				matchStore.SetConnection(hash, id, role, conn)
-				playerID = id
-			} else {
-				conn.WriteJSON(map[string]interface{}{
-					"type":    "error",
-					"message": "Match is full",
-				})
-				return
+			if err := matchStore.CheckRoomAccess(hash, conn, payload.JoinCode, payload.Password); err != nil {
+				return NewProtocolError(ErrAccessDenied, err.Error())
+			}
+		}
+
+		if playerID == "" && match.IsMultiplayer() {
+			id, playerSeat, playerTeam, err := matchStore.AddPlayer(hash, conn, payload.Team)
+			if err != nil {
+				// tells a player asking for a full team which one it was
+				return NewProtocolError(ErrMatchFull, err.Error())
 			}
+			role = "player"
+			playerID = id
+			seat = playerSeat
+			team = playerTeam
+		} else if playerID == "" {
+			seatRole, id, err := matchStore.ClaimSeat(hash, conn)
+			if err != nil {
+				return NewProtocolError(ErrMatchFull, "Match is full")
+			}
+			role = seatRole
+			playerID = id
 		} else {
-			existingRole, found := matchStore.CanReconnect(hash, playerID)
+			if err := requireReconnectToken(conn, hash, playerID, payload.Token); err != nil {
+				return err
+			}
+			existingRole, found := matchStore.CanReconnect(hash, playerID, payload.Token)
 			if !found {
-				conn.WriteJSON(map[string]interface{}{
-					"type":    "error",
-					"message": "Cannot reconnect",
-				})
-				return
+				return NewProtocolError(ErrNotAllowed, "Cannot reconnect")
 			}
 			role = existingRole
 			matchStore.SetConnection(hash, playerID, role, conn)
+			seat, team = matchStore.PlayerSeat(hash, playerID)
 		}
 
-		StorePlayerIDs(hash, match.HostID, match.GuestID)
+		accountID, err := matchStore.BindAccount(hash, playerID, ResolveIdentity(payload.Identity))
+		if err != nil {
+			return NewProtocolError(ErrMatchNotFound, "Match not found")
+		}
 
+		if !match.IsMultiplayer() {
+			StorePlayerIDs(hash, match.HostID, match.GuestID)
+		}
+		matchStore.SaveMatch(hash)
+		rating := AccountRating(accountID)
+
+		match.mutex.RLock()
 		authok := AuthOkPayload{
 			Type:         "auth_ok",
 			PlayerId:     playerID,
+			Token:        ReconnectToken(playerID),
+			AccountId:    accountID,
+			Identity:     IdentityToken(accountID),
+			Rating:       rating,
 			Role:         role,
+			Seat:         seat,
+			Team:         team,
+			JoinCode:     match.JoinCode,
 			RoomState:    match.State,
 			CurrentRound: match.GameState.CurrentRound,
 			HostScore:    match.GameState.HostScore,
 			GuestScore:   match.GameState.GuestScore,
+			Scores:       match.GameState.Scores,
+			TeamScores:   match.GameState.TeamScores,
+			RoundCount:   match.Config.RoundCount,
+			Config:       &match.Config,
+			Series:       match.Series,
 		}
-		err := conn.WriteJSON(authok)
+		err = conn.WriteJSON(authok)
+		match.mutex.RUnlock()
 		if err != nil {
 			LogBroadcastError(hash, role, err)
-			return
+			return nil
+		}
+		// starting the match waits for the prefetch
+		AckEvent(conn)
+
+		if match.CurrentState() == "waiting" {
+			PublishRoomState(match)
 		}
 
 		playerCount := GetPlayerCount(match)
-		if playerCount == 2 && match.State == "waiting" {
+		if match.IsMultiplayer() {
+			matchStore.BroadcastPlayers(hash)
+			if playerCount < match.Config.MaxPlayers {
+				return nil
+			}
+		} else if playerCount != 2 {
+			return nil
+		}
+
+		if match.CurrentState() == "waiting" {
 			LogMatchEvent(hash, "both_players_connected", logrus.Fields{
 				"player_count": playerCount,
 			})
-			select {
-			case <-match.ReadyChan:
-				match.mutex.Lock()
-				if match.State == "waiting" {
-					match.State = "playing"
-					LogMatchEvent(hash, "game_started", logrus.Fields{
-						"player_count": playerCount,
-					})
-					PublishRoomState(hash, match.State, playerCount)
-				} else {
-					LogMatchEvent(hash, "game_already_started", logrus.Fields{
-						"current_state": match.State,
-					})
-				}
-				match.mutex.Unlock()
+			startMatch(conn, hash)
+		}
+		return nil
+	}))
 
-				err := matchStore.StartNextRound(hash)
-				if err != nil {
-					LogGameRound(hash, 1, "start_error", logrus.Fields{
-						"error": err.Error(),
-					})
-				} else {
-					go roundTimeoutChecker(context.Background(), hash)
-				}
-			case <-time.After(30 * time.Second):
-				LogMatchEvent(hash, "game_ready_timeout", logrus.Fields{})
-				conn.WriteJSON(map[string]interface{}{
-					"type":    "error",
-					"message": "Game initialization timeout",
-				})
-				return
-			}
+	// lets seat 1 of an ffa room start before every seat is filled
+	eventRouter.On("start_game", Handle(func(conn Connection, hash string, payload *EmptyRequest) *ProtocolError {
+		match, exists := matchStore.GetMatch(hash)
+		if !exists || !match.IsMultiplayer() {
+			return NewProtocolError(ErrNotAllowed, "Cannot start game")
 		}
-	})
 
-	eventRouter.On("reconnect", func(conn *websocket.Conn, data interface{}) {
-		dataMap, ok := data.(map[string]interface{})
-		if !ok {
-			conn.WriteJSON(map[string]interface{}{"type": "error", "message": "invalid payload"})
-			return
+		role, playerID := matchStore.ConnectionRole(hash, conn)
+		if seat, _ := matchStore.PlayerSeat(hash, playerID); role != "player" || seat != 1 {
+			return NewProtocolError(ErrNotAllowed, "Only seat 1 can start the game")
 		}
 
-		hash, _ := dataMap["hash"].(string)
-		if hash == "" {
-			conn.WriteJSON(map[string]interface{}{"type": "error", "message": "Missing hash"})
-			return
+		if err := CanStartMultiplayer(match); err != nil {
+			return NewProtocolError(ErrInvalidState, err.Error())
 		}
 
-		playerID, _ := dataMap["playerId"].(string)
-		if playerID == "" {
-			playerID, _ = dataMap["playerID"].(string)
+		AckEvent(conn)
+		startMatch(conn, hash)
+		return nil
+	}))
+
+	// the host of a private room adds a password as a second way in besides the join code
+	eventRouter.On("set_password", Handle(func(conn Connection, hash string, payload *SetPasswordRequest) *ProtocolError {
+		match, exists := matchStore.GetMatch(hash)
+		if !exists {
+			return NewProtocolError(ErrMatchNotFound, "Match not found")
 		}
 
-		role, canReconnect := matchStore.CanReconnect(hash, playerID)
-		if !canReconnect {
-			conn.WriteJSON(map[string]interface{}{
-				"type":    "error",
-				"message": "Cannot reconnect",
-			})
-			return
+		role, playerID := matchStore.ConnectionRole(hash, conn)
+		seat, _ := matchStore.PlayerSeat(hash, playerID)
+		if role != "host" && (role != "player" || seat != 1) {
+			return NewProtocolError(ErrNotAllowed, "Only the host can set a password")
 		}
 
-		matchStore.ReconnectPlayer(hash, role, conn)
+		match.mutex.RLock()
+		private := match.Config.Visibility == "private"
+		state := match.State
+		match.mutex.RUnlock()
+		if !private {
+			return NewProtocolError(ErrInvalidState, "Only private rooms take a password")
+		}
+		if state != "waiting" {
+			return NewProtocolError(ErrInvalidState, "Match already started")
+		}
 
-		match, _ := matchStore.GetMatch(hash)
-		conn.WriteJSON(ReconnectOkPayload{
-			Type:      "reconnect_ok",
-			PlayerId:  playerID,
-			Role:      role,
-			RoomState: match.State,
-			GameState: &match.GameState,
-		})
-	})
+		if err := matchStore.SetRoomPassword(hash, payload.Password); err != nil {
+			return NewProtocolError(ErrMatchNotFound, err.Error())
+		}
+		return nil
+	}))
 
-	eventRouter.On("submit_answer", func(conn *websocket.Conn, data interface{}) {
-		dataMap, ok := data.(map[string]interface{})
-		if !ok {
-			conn.WriteJSON(map[string]interface{}{"type": "error", "message": "invalid payload"})
-			return
+	eventRouter.On("spectate", Handle(func(conn Connection, hash string, payload *SpectateRequest) *ProtocolError {
+		match, exists := findMatch(hash)
+		if !exists {
+			return NewProtocolError(ErrMatchNotFound, "Match not found")
 		}
 
-		hash, _ := dataMap["hash"].(string)
-		if hash == "" {
-			conn.WriteJSON(map[string]interface{}{"type": "error", "message": "Missing hash"})
-			return
+		if err := matchStore.CheckRoomAccess(hash, conn, payload.JoinCode, payload.Password); err != nil {
+			return NewProtocolError(ErrAccessDenied, err.Error())
 		}
 
-		playerID, _ := dataMap["playerId"].(string)
-		if playerID == "" {
-			playerID, _ = dataMap["playerID"].(string)
+		spectatorID, err := matchStore.AddSpectator(hash, conn)
+		if err != nil {
+			return NewProtocolError(ErrNotAllowed, "Cannot spectate")
 		}
 
-		countryCode, _ := dataMap["countryCode"].(string)
-		countryName, _ := dataMap["countryName"].(string)
+		match.mutex.RLock()
+		authok := AuthOkPayload{
+			Type:         "auth_ok",
+			PlayerId:     spectatorID,
+			Role:         "spectator",
+			RoomState:    match.State,
+			CurrentRound: match.GameState.CurrentRound,
+			HostScore:    match.GameState.HostScore,
+			GuestScore:   match.GameState.GuestScore,
+			RoundCount:   match.Config.RoundCount,
+			Config:       &match.Config,
+		}
+		match.mutex.RUnlock()
+		conn.WriteJSON(authok)
+		return nil
+	}))
 
-		if playerID == "" || countryCode == "" {
-			conn.WriteJSON(map[string]interface{}{"type": "error", "message": "Missing fields"})
-			return
+	eventRouter.On("reconnect", Handle(func(conn Connection, hash string, payload *ReconnectRequest) *ProtocolError {
+		playerID := payload.PlayerID
+
+		if _, exists := findMatch(hash); !exists {
+			return NewProtocolError(ErrMatchNotFound, "Match not found")
+		}
+
+		if err := requireReconnectToken(conn, hash, playerID, payload.Token); err != nil {
+			return err
+		}
+		role, canReconnect := matchStore.CanReconnect(hash, playerID, payload.Token)
+		if !canReconnect {
+			return NewProtocolError(ErrNotAllowed, "Cannot reconnect")
+		}
+
+		// reconnect_ok is followed by the room messages sent after lastSeq
+		if err := matchStore.ReconnectWithReplay(hash, playerID, role, conn, payload.LastSeq); err != nil {
+			return NewProtocolError(ErrMatchNotFound, "Match not found")
+		}
+
+		if role == "player" {
+			matchStore.BroadcastPlayers(hash)
 		}
+		return nil
+	}))
 
-		matchStore.SubmitAnswer(hash, playerID, countryCode, countryName)
+	// once every player agreed a new match with the same seats is opened and the series score carried over
+	eventRouter.On("rematch_request", Handle(func(conn Connection, hash string, payload *RematchRequest) *ProtocolError {
+		return handleRematchVote(conn, hash, payload.BestOf, false)
+	}))
+
+	eventRouter.On("rematch_accept", Handle(func(conn Connection, hash string, payload *RematchRequest) *ProtocolError {
+		return handleRematchVote(conn, hash, payload.BestOf, true)
+	}))
+
+	eventRouter.On("submit_answer", Handle(func(conn Connection, hash string, payload *SubmitAnswerRequest) *ProtocolError {
+		if matchStore.IsSpectator(hash, conn) {
+			return NewProtocolError(ErrNotAllowed, "Spectators cannot submit answers")
+		}
+
+		// answers always count for the seat this socket holds
+		role, playerID := matchStore.ConnectionRole(hash, conn)
+		if role == "" {
+			return NewProtocolError(ErrNotAllowed, "Not seated in this match")
+		}
+
+		if err := matchStore.SubmitAnswer(hash, playerID, payload.CountryCode, payload.CountryName, payload.Pin()); err != nil {
+			return NewProtocolError(ErrInvalidState, "Cannot submit answer")
+		}
+		// the answer is locked in, ack before the round result goes out
+		AckEvent(conn)
 
 		shouldEnd, _ := matchStore.ShouldEndRound(hash)
 		if shouldEnd {
@@ -427,48 +711,16 @@ func main() {
 				LogGameRound(hash, 0, "end_error", logrus.Fields{
 					"error": err.Error(),
 				})
-				return
+				return nil
 			}
 
-			matchStore.BroadcastToRoom(hash, result)
-
-			match, _ := matchStore.GetMatch(hash)
-
-			match.mutex.RLock()
-			currentRound := match.GameState.CurrentRound
-			hostScore := match.GameState.HostScore
-			guestScore := match.GameState.GuestScore
-			match.mutex.RUnlock()
-
-			if currentRound < 5 {
-				time.AfterFunc(3*time.Second, func() {
-					matchStore.StartNextRound(hash)
-				})
-			} else {
-				gameEnd := GameEndPayload{
-					Type:       "game_end",
-					HostScore:  hostScore,
-					GuestScore: guestScore,
-					Winner:     GetWinner(hostScore, guestScore),
-				}
-				matchStore.BroadcastToRoom(hash, gameEnd)
-
-				match.mutex.Lock()
-				match.State = "finished"
-				match.mutex.Unlock()
-
-				PublishRoomState(hash, "finished", 2)
-			}
+			advanceMatch(hash, result)
 		}
-	})
+		return nil
+	}))
 
 	// WebSocket middleware for game connections
-	app.Use("/ws", func(c *fiber.Ctx) error {
-		if websocket.IsWebSocketUpgrade(c) {
-			return c.Next()
-		}
-		return fiber.ErrUpgradeRequired
-	})
+	app.Use("/ws", rejectWhileDraining)
 
 	// Game WebSocket connection
 	app.Get("/ws", websocket.New(func(c *websocket.Conn) {
@@ -476,17 +728,41 @@ func main() {
 	}))
 
 	// Discovery WebSocket connection
-	app.Use("/ws/discovery", func(c *fiber.Ctx) error {
-		if websocket.IsWebSocketUpgrade(c) {
-			return c.Next()
-		}
-		return fiber.ErrUpgradeRequired
-	})
+	app.Use("/ws/discovery", rejectWhileDraining)
 
 	app.Get("/ws/discovery", websocket.New(func(c *websocket.Conn) {
 		handleDiscoveryConnection(c)
 	}))
 
+	// Match history
+	app.Get("/history/accounts/:accountId", handleAccountHistory)
+
+	// Ratings
+	app.Get("/ratings/:accountId", handleAccountRating)
+
+	// Matchmaking WebSocket connection
+	app.Use("/ws/matchmaking", rejectWhileDraining)
+
+	app.Get("/ws/matchmaking", websocket.New(func(c *websocket.Conn) {
+		handleMatchmakingConnection(c)
+	}))
+
+	// Tournament brackets
+	app.Get("/tournaments/:id", handleTournament)
+	app.Get("/tournaments/:id/game", handleTournamentGame)
+
+	app.Use("/ws/tournaments", rejectWhileDraining)
+
+	app.Get("/ws/tournaments", websocket.New(func(c *websocket.Conn) {
+		handleTournamentConnection(c)
+	}))
+
+	// Admin API
+	RegisterAdminRoutes(app)
+
+	// Prometheus metrics
+	app.Get("/metrics", MetricsHandler())
+
 	// Status endpoint
 	app.Get("/status", func(c *fiber.Ctx) error {
 		localTime := time.Now().Local()
@@ -496,7 +772,9 @@ func main() {
 		return c.JSON(fiber.Map{
 			"status":                "ok",
 			"time":                  localTime,
-			"active_ws_connections": len(matchStore.matches),
+			"active_ws_connections": activeGameConnections.Load(),
+			"discovery_connections": activeDiscoveryConnections.Load(),
+			"active_matches":        len(matchStore.Hashes()),
 			"memory_stats": map[string]uint64{
 				"Alloc":      mem.Alloc,
 				"TotalAlloc": mem.TotalAlloc,
@@ -506,7 +784,21 @@ func main() {
 		})
 	})
 
-	err := app.Listen(":8080")
+	shutdownCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		handleShutdown(shutdownCtx, app)
+		close(shutdownDone)
+	}()
+
+	LogWithFields(logrus.Fields{
+		"event":   "server_start",
+		"address": ":8080",
+	}).Info("Starting server")
+
+	err = app.Listen(":8080")
 	if err != nil {
 		LogWithFields(logrus.Fields{
 			"event": "server_start_error",
@@ -514,8 +806,8 @@ func main() {
 		}).Fatal("Failed to start server")
 	}
 
+	<-shutdownDone
 	LogWithFields(logrus.Fields{
-		"event":   "server_start",
-		"address": ":8080",
-	}).Info("Server started successfully")
+		"event": "server_stopped",
+	}).Info("Server stopped")
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// hands saved records to the test, history is saved in the background
+type recordedHistory struct {
+	saved chan MatchHistoryRecord
+}
+
+func (history *recordedHistory) SaveMatch(record MatchHistoryRecord) error {
+	history.saved <- record
+	return nil
+}
+
+func (history *recordedHistory) AccountMatches(accountID string, limit int) ([]MatchHistoryRecord, error) {
+	return nil, nil
+}
+
+func TestFinishMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		forced bool
+	}{
+		{"played out", false},
+		{"ended by an admin", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			matchStore = NewMatchStore()
+			ratings := NewMemoryRatingRepository()
+			history := &recordedHistory{saved: make(chan MatchHistoryRecord, 1)}
+			ratingRepository, matchHistory = ratings, history
+			t.Cleanup(func() { ratingRepository, matchHistory = nil, nil })
+
+			tournament, err := NewTournament([]string{"host", "guest"}, "single", 1, DefaultMatchConfig())
+			if err != nil {
+				t.Fatalf("NewTournament() error: %v", err)
+			}
+			bracketMatch := tournament.Matches[tournament.Order[0]]
+			bracketMatch.Players = [2]string{"host", "guest"}
+			bracketMatch.State = "playing"
+			bracketMatch.Hash = "room"
+			tournamentStore.Add(tournament)
+			t.Cleanup(func() { tournamentStore.Remove(tournament.ID) })
+
+			match := newPlayingMatch(matchStore, "room")
+			match.Accounts = map[string]string{"host": "host-account", "guest": "guest-account"}
+			match.Series = &SeriesState{ID: "series", BestOf: 3, Game: 1, Wins: make(map[string]int)}
+			match.TournamentID = tournament.ID
+			match.BracketMatchID = bracketMatch.ID
+			match.GameState.HostScore = 5000
+
+			if !finishMatch("room", test.forced) {
+				t.Fatal("finishMatch() did not finish the match")
+			}
+			if finishMatch("room", test.forced) {
+				t.Error("finishMatch() finished the match twice")
+			}
+
+			counted := !test.forced
+			rating, _ := ratings.GetRating("host-account")
+			if rated := rating.Rating != DefaultRating; rated != counted {
+				t.Errorf("host rating %d, want rated %v", rating.Rating, counted)
+			}
+			if scored := match.Series.Wins["host"] == 1; scored != counted {
+				t.Errorf("series wins %v, want the win counted %v", match.Series.Wins, counted)
+			}
+			recorded := false
+			select {
+			case <-history.saved:
+				recorded = true
+			case <-time.After(100 * time.Millisecond):
+			}
+			if recorded != counted {
+				t.Errorf("history recorded %v, want %v", recorded, counted)
+			}
+			if advanced := bracketMatch.State == "finished"; advanced != counted {
+				t.Errorf("bracket match %s, want advanced %v", bracketMatch.State, counted)
+			}
+		})
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// the rating gap a fresh ticket accepts, widened every step until the max
+const MatchmakingBaseWindow int = 50
+const MatchmakingWindowStep int = 50
+const MatchmakingWindowStepSeconds int = 5
+const MatchmakingMaxWindow int = 500
+
+// every node keeps the tickets of its own sockets, with redis they are also
+// shared so the node holding the matchmaker lock can pair players across nodes
+type MatchmakingQueue struct {
+	mutex   sync.Mutex
+	tickets map[string]*MatchmakingTicket
+}
+
+var matchmakingQueue = &MatchmakingQueue{tickets: make(map[string]*MatchmakingTicket)}
+
+const matchmakingTicketsKey = "geofinder:matchmaking:tickets"
+const matchmakingLockKey = "geofinder:matchmaking:lock"
+const matchmakingLockTTL = 3 * time.Second
+
+// removes a pair from the shared queue only if neither ticket left in the meantime
+var takeTicketsScript = redis.NewScript(`
+if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 1 and redis.call("HEXISTS", KEYS[1], ARGV[2]) == 1 then
+	redis.call("HDEL", KEYS[1], ARGV[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// carries match_found to the node that holds the ticket's socket
+func matchmakingChannel(node string) string {
+	return "geofinder:matchmaking:" + node
+}
+
+// how far apart two ratings may be for this ticket after waiting so long
+func (ticket *MatchmakingTicket) Window(now time.Time) int {
+	steps := int(now.Sub(ticket.JoinedAt).Seconds()) / MatchmakingWindowStepSeconds
+	return min(MatchmakingBaseWindow+steps*MatchmakingWindowStep, MatchmakingMaxWindow)
+}
+
+func (queue *MatchmakingQueue) Join(ticket *MatchmakingTicket) int {
+	queue.mutex.Lock()
+	queue.tickets[ticket.ID] = ticket
+	queue.mutex.Unlock()
+
+	if redisClient != nil {
+		data, err := json.Marshal(ticket)
+		if err == nil {
+			err = redisClient.HSet(context.Background(), matchmakingTicketsKey, ticket.ID, data).Err()
+		}
+		if err != nil {
+			LogRedisError("matchmaking_join", err)
+		}
+	}
+	return queue.Size()
+}
+
+func (queue *MatchmakingQueue) Leave(ticketID string) bool {
+	queue.mutex.Lock()
+	_, found := queue.tickets[ticketID]
+	delete(queue.tickets, ticketID)
+	queue.mutex.Unlock()
+
+	if redisClient != nil {
+		if err := redisClient.HDel(context.Background(), matchmakingTicketsKey, ticketID).Err(); err != nil {
+			LogRedisError("matchmaking_leave", err)
+		}
+	}
+	return found
+}
+
+func (queue *MatchmakingQueue) Size() int {
+	if redisClient != nil {
+		if size, err := redisClient.HLen(context.Background(), matchmakingTicketsKey).Result(); err == nil {
+			return int(size)
+		}
+	}
+
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	return len(queue.tickets)
+}
+
+// the tickets of every node, tickets of nodes that died are dropped
+func sharedTickets() []*MatchmakingTicket {
+	ctx := context.Background()
+	entries, err := redisClient.HGetAll(ctx, matchmakingTicketsKey).Result()
+	if err != nil {
+		LogRedisError("matchmaking_tickets", err)
+		return nil
+	}
+
+	alive := make(map[string]bool)
+	tickets := make([]*MatchmakingTicket, 0, len(entries))
+	for id, data := range entries {
+		var ticket MatchmakingTicket
+		if err := json.Unmarshal([]byte(data), &ticket); err != nil {
+			redisClient.HDel(ctx, matchmakingTicketsKey, id)
+			continue
+		}
+		if _, checked := alive[ticket.Node]; !checked {
+			nodeAlive, err := IsNodeAlive(ticket.Node)
+			alive[ticket.Node] = err != nil || nodeAlive
+		}
+		if !alive[ticket.Node] {
+			redisClient.HDel(ctx, matchmakingTicketsKey, id)
+			continue
+		}
+		tickets = append(tickets, &ticket)
+	}
+	return tickets
+}
+
+// only one node pairs at a time so no ticket ends up in two rooms
+func holdMatchmakerLock() bool {
+	if redisClient == nil {
+		return true
+	}
+
+	ctx := context.Background()
+	acquired, err := redisClient.SetNX(ctx, matchmakingLockKey, nodeID, matchmakingLockTTL).Result()
+	if err != nil {
+		LogRedisError("matchmaking_lock", err)
+		return false
+	}
+	if acquired {
+		return true
+	}
+	refreshed, err := refreshOwnershipScript.Run(ctx, redisClient, []string{matchmakingLockKey}, nodeID, matchmakingLockTTL.Milliseconds()).Int()
+	return err == nil && refreshed == 1
+}
+
+func regionsMatch(a string, b string) bool {
+	return a == "" || b == "" || a == b
+}
+
+func ratingGap(a int, b int) int {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// takes the pairs that fit inside both tickets' windows out of the queue
+func (queue *MatchmakingQueue) takePairs(now time.Time) [][2]*MatchmakingTicket {
+	if redisClient != nil {
+		var pairs [][2]*MatchmakingTicket
+		for _, pair := range pairTickets(sharedTickets(), now) {
+			took, err := takeTicketsScript.Run(context.Background(), redisClient, []string{matchmakingTicketsKey}, pair[0].ID, pair[1].ID).Int()
+			if err != nil {
+				LogRedisError("matchmaking_take", err)
+				continue
+			}
+			if took == 1 {
+				pairs = append(pairs, pair)
+			}
+		}
+		return pairs
+	}
+
+	queue.mutex.Lock()
+	waiting := make([]*MatchmakingTicket, 0, len(queue.tickets))
+	for _, ticket := range queue.tickets {
+		waiting = append(waiting, ticket)
+	}
+	queue.mutex.Unlock()
+
+	return pairTickets(waiting, now)
+}
+
+// pairs tickets that fit inside both windows, the longest waiting tickets get picked first
+func pairTickets(waiting []*MatchmakingTicket, now time.Time) [][2]*MatchmakingTicket {
+	sort.Slice(waiting, func(i, j int) bool {
+		return waiting[i].JoinedAt.Before(waiting[j].JoinedAt)
+	})
+
+	var pairs [][2]*MatchmakingTicket
+	paired := make(map[string]bool)
+	for i, ticket := range waiting {
+		if paired[ticket.ID] {
+			continue
+		}
+
+		var best *MatchmakingTicket
+		for _, candidate := range waiting[i+1:] {
+			if paired[candidate.ID] || candidate.AccountID == ticket.AccountID || !regionsMatch(ticket.Region, candidate.Region) {
+				continue
+			}
+			gap := ratingGap(ticket.Rating, candidate.Rating)
+			if gap > min(ticket.Window(now), candidate.Window(now)) {
+				continue
+			}
+			if best == nil || gap < ratingGap(ticket.Rating, best.Rating) {
+				best = candidate
+			}
+		}
+
+		if best != nil {
+			paired[ticket.ID] = true
+			paired[best.ID] = true
+			pairs = append(pairs, [2]*MatchmakingTicket{ticket, best})
+		}
+	}
+	return pairs
+}
+
+// pairs queued players every second and opens a room for each pair
+func runMatchmaker() {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if draining.Load() || !holdMatchmakerLock() {
+			continue
+		}
+		for _, pair := range matchmakingQueue.takePairs(time.Now()) {
+			createMatchmadeRoom(pair[0], pair[1])
+		}
+	}
+}
+
+func createMatchmadeRoom(a *MatchmakingTicket, b *MatchmakingTicket) {
+	hash := IssueRoomHash("mm-")
+	if _, err := ClaimMatchOwnership(hash); err != nil {
+		LogRedisError("claim_ownership", err)
+	}
+
+	region := a.Region
+	if region == "" {
+		region = b.Region
+	}
+
+	config := DefaultMatchConfig()
+	config.Region = region
+	config.Visibility = "unlisted"
+	matchStore.CreateMatch(hash, config)
+	LogMatchEvent(hash, "matchmade", logrus.Fields{
+		"ratings":      []int{a.Rating, b.Rating},
+		"region":       region,
+		"wait_seconds": []int64{int64(time.Since(a.JoinedAt).Seconds()), int64(time.Since(b.JoinedAt).Seconds())},
+	})
+
+	for _, pair := range [][2]*MatchmakingTicket{{a, b}, {b, a}} {
+		sendMatchFound(pair[0], MatchFoundPayload{
+			Type:           "match_found",
+			Hash:           hash,
+			Region:         region,
+			Rating:         pair[0].Rating,
+			OpponentRating: pair[1].Rating,
+		})
+	}
+}
+
+func sendMatchFound(ticket *MatchmakingTicket, payload MatchFoundPayload) {
+	if redisClient == nil || ticket.Node == nodeID {
+		matchmakingQueue.deliver(ticket.ID, payload)
+		return
+	}
+
+	data, err := json.Marshal(MatchFoundNotice{TicketID: ticket.ID, Payload: payload})
+	if err != nil {
+		return
+	}
+	if err := redisClient.Publish(context.Background(), matchmakingChannel(ticket.Node), data).Err(); err != nil {
+		LogRedisError("matchmaking_publish", err)
+	}
+}
+
+// hands match_found to a socket on this node and takes its ticket out of the queue
+func (queue *MatchmakingQueue) deliver(ticketID string, payload MatchFoundPayload) {
+	queue.mutex.Lock()
+	ticket, found := queue.tickets[ticketID]
+	delete(queue.tickets, ticketID)
+	queue.mutex.Unlock()
+
+	if found {
+		ticket.Conn.WriteJSON(payload)
+	}
+}
+
+// delivers match_found for rooms opened by the matchmaker on another node
+func SubscribeToMatchmaking(ctx context.Context) {
+	channel := matchmakingChannel(nodeID)
+	pubsub := redisClient.Subscribe(ctx, channel)
+	defer pubsub.Close()
+
+	LogRedisSubscribe(channel)
+
+	for msg := range pubsub.Channel() {
+		var notice MatchFoundNotice
+		if err := json.Unmarshal([]byte(msg.Payload), &notice); err != nil {
+			continue
+		}
+		matchmakingQueue.deliver(notice.TicketID, notice.Payload)
+	}
+}
+
+func handleMatchmakingConnection(c *websocket.Conn) {
+	session := &MatchmakingSession{Conn: NewProtocolConn(c)}
+	if region, ok := normalizeRegion(c.Query("region")); ok {
+		session.Region = region
+	}
+	router := session.router()
+
+	defer func() {
+		if session.Ticket != nil && matchmakingQueue.Leave(session.Ticket.ID) {
+			LogPlayerAction("", session.Ticket.AccountID, "queue_left", logrus.Fields{})
+		}
+	}()
+
+	for {
+		messageType, data, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+		if messageType != websocket.TextMessage {
+			continue
+		}
+
+		var message struct {
+			ID    json.RawMessage `json:"id"`
+			Event string          `json:"event"`
+			Data  json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(data, &message); err != nil || message.Event == "" {
+			sendError(session.Conn, "", message.ID, NewProtocolError(ErrInvalidMessage, "Expected an event and its data"))
+			continue
+		}
+		router.Handle(session.Conn, "", message.Event, message.ID, message.Data)
+	}
+}
+
+// the matchmaking events, they act on this session's ticket
+func (session *MatchmakingSession) router() *EventRouter {
+	router := NewEventRouter()
+	router.On("ping", Handle(func(conn Connection, hash string, payload *EmptyRequest) *ProtocolError {
+		conn.WriteMessage(websocket.TextMessage, []byte("pong"))
+		return nil
+	}))
+	router.On("join_queue", Handle(session.joinQueue))
+	router.On("leave_queue", Handle(session.leaveQueue))
+	return router
+}
+
+func (session *MatchmakingSession) joinQueue(conn Connection, hash string, payload *JoinQueueRequest) *ProtocolError {
+	if session.Ticket != nil {
+		matchmakingQueue.Leave(session.Ticket.ID)
+	}
+
+	region := payload.Region
+	if region == "" {
+		region = session.Region
+	}
+	accountID := ResolveIdentity(payload.Identity)
+
+	// the matchmaker writes match_found from its own goroutine, the socket takes turns
+	session.Ticket = &MatchmakingTicket{
+		ID:        uuid.NewString(),
+		AccountID: accountID,
+		Rating:    AccountRating(accountID),
+		Region:    region,
+		Node:      nodeID,
+		Conn:      session.Conn,
+		JoinedAt:  time.Now(),
+	}
+	queueSize := matchmakingQueue.Join(session.Ticket)
+	LogPlayerAction("", accountID, "queue_joined", logrus.Fields{
+		"rating": session.Ticket.Rating,
+		"region": region,
+	})
+
+	conn.WriteJSON(QueueJoinedPayload{
+		Type:      "queue_joined",
+		AccountId: accountID,
+		Identity:  IdentityToken(accountID),
+		Rating:    session.Ticket.Rating,
+		Region:    region,
+		QueueSize: queueSize,
+	})
+	return nil
+}
+
+func (session *MatchmakingSession) leaveQueue(conn Connection, hash string, payload *EmptyRequest) *ProtocolError {
+	if session.Ticket != nil {
+		matchmakingQueue.Leave(session.Ticket.ID)
+		session.Ticket = nil
+	}
+	conn.WriteJSON(map[string]interface{}{"type": "queue_left"})
+	return nil
+}
@@ -6,11 +6,13 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/gofiber/websocket/v2"
 	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
 	"github.com/sirupsen/logrus"
 )
 
+const MaxSpectators int = 50
+
 func NewMatchStore() *MatchStore {
 	return &MatchStore{
 		matches: make(map[string]*Match),
@@ -24,7 +26,15 @@ func (store *MatchStore) GetMatch(hash string) (*Match, bool) {
 	return match, exitsts
 }
 
-func (store *MatchStore) CreateMatch(hash string) *Match {
+// the match state for callers that don't hold the match lock
+func (match *Match) CurrentState() string {
+	match.mutex.RLock()
+	defer match.mutex.RUnlock()
+
+	return match.State
+}
+
+func (store *MatchStore) CreateMatch(hash string, config MatchConfig) *Match {
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
@@ -34,37 +44,135 @@ func (store *MatchStore) CreateMatch(hash string) *Match {
 
 	_, cancel := context.WithCancel(context.Background())
 	match := &Match{
-		Hash:      hash,
-		State:     "waiting",
-		GameReady: false,
-		ReadyChan: make(chan struct{}),
-		CreatedAt: time.Now(),
-		Cancel:    cancel,
+		Hash:       hash,
+		State:      "waiting",
+		GameReady:  false,
+		ReadyChan:  make(chan struct{}),
+		CreatedAt:  time.Now(),
+		Cancel:     cancel,
+		Config:     config,
+		Spectators: make(map[string]*Spectator),
+		Players:    make(map[string]*Player),
 		GameState: GameState{
-			Rounds: [5]Round{},
+			Rounds: make([]Round, config.RoundCount),
 		},
 	}
+	if match.IsMultiplayer() {
+		match.GameState.Scores = make(map[string]int)
+	}
+	if match.IsTeams() {
+		match.GameState.TeamScores = make(map[string]int)
+	}
+	store.protectMatch(match)
 	store.matches[hash] = match
-	LogMatchLifecycle(hash, "created", logrus.Fields{})
-
-	go func(m *Match) {
-		LogMatchLifecycle(hash, "prefetching_started", logrus.Fields{})
-		ok, err := PrefetchRounds(m)
-		if ok && err == nil {
-			m.mutex.Lock()
-			m.GameReady = true
-			m.mutex.Unlock()
-			m.ReadyOnce.Do(func() {
-				close(m.ReadyChan)
-			})
-			LogMatchLifecycle(hash, "ready", logrus.Fields{})
-		} else {
-			LogMatchLifecycle(hash, "prefetch_failed", logrus.Fields{
-				"error": err.Error(),
-			})
+	LogMatchLifecycle(hash, "created", logrus.Fields{
+		"mode":          config.Mode,
+		"max_players":   config.MaxPlayers,
+		"scoring_mode":  config.ScoringMode,
+		"round_count":   config.RoundCount,
+		"round_seconds": config.RoundSeconds,
+	})
+
+	matchesCreated.Inc()
+	go store.prefetchMatch(match)
+
+	return match
+}
+
+func (store *MatchStore) prefetchMatch(m *Match) {
+	hash := m.Hash
+	store.SaveMatch(hash)
+	LogMatchLifecycle(hash, "prefetching_started", logrus.Fields{})
+	ok, err := PrefetchRounds(m)
+	if ok && err == nil {
+		m.mutex.Lock()
+		m.GameReady = true
+		m.mutex.Unlock()
+		m.ReadyOnce.Do(func() {
+			close(m.ReadyChan)
+		})
+		store.SaveMatch(hash)
+		LogMatchLifecycle(hash, "ready", logrus.Fields{})
+	} else {
+		prefetchFailures.Inc()
+		LogMatchLifecycle(hash, "prefetch_failed", logrus.Fields{
+			"error": err.Error(),
+		})
+	}
+}
+
+// rebuilds a match from its last redis snapshot, returns nil if there is
+// nothing to restore or the match is already in memory
+func (store *MatchStore) RestoreMatch(hash string) *Match {
+	if redisClient == nil {
+		return nil
+	}
+
+	snapshot, err := LoadMatchState(hash)
+	if err != nil {
+		if err != redis.Nil {
+			LogRedisError("load_match_state", err)
 		}
-	}(match)
+		return nil
+	}
 
+	store.mutex.Lock()
+	if _, exists := store.matches[hash]; exists {
+		store.mutex.Unlock()
+		return nil
+	}
+
+	_, cancel := context.WithCancel(context.Background())
+	match := &Match{
+		Hash:             hash,
+		HostID:           snapshot.HostID,
+		GuestID:          snapshot.GuestID,
+		Players:          snapshot.Players,
+		Accounts:         snapshot.Accounts,
+		JoinCode:         snapshot.JoinCode,
+		PasswordHash:     snapshot.PasswordHash,
+		PasswordSalt:     snapshot.PasswordSalt,
+		Series:           snapshot.Series,
+		RematchHash:      snapshot.RematchHash,
+		TournamentID:     snapshot.Tournament,
+		BracketMatchID:   snapshot.BracketMatch,
+		LastSeq:          snapshot.LastSeq,
+		Outbox:           snapshot.Outbox,
+		OutboxTrimmedSeq: snapshot.TrimmedSeq,
+		GameState:        snapshot.GameState,
+		Config:           snapshot.Config,
+		State:            snapshot.State,
+		Seed:             snapshot.Seed,
+		CreatedAt:        snapshot.CreatedAt,
+		GameReady:        snapshot.GameReady,
+		ReadyChan:        make(chan struct{}),
+		Cancel:           cancel,
+		Spectators:       make(map[string]*Spectator),
+	}
+	if match.Players == nil {
+		match.Players = make(map[string]*Player)
+	}
+	if len(match.GameState.Rounds) == 0 {
+		match.GameState.Rounds = make([]Round, match.Config.RoundCount)
+	}
+	if match.GameReady {
+		match.ReadyOnce.Do(func() {
+			close(match.ReadyChan)
+		})
+	}
+	store.matches[hash] = match
+	store.mutex.Unlock()
+
+	LogMatchLifecycle(hash, "restored", logrus.Fields{
+		"state":          snapshot.State,
+		"current_round":  snapshot.GameState.CurrentRound,
+		"previous_owner": snapshot.Owner,
+		"saved_at":       snapshot.SavedAt,
+	})
+
+	if !match.GameReady && match.State == "waiting" {
+		go store.prefetchMatch(match)
+	}
 	return match
 }
 
@@ -76,10 +184,46 @@ func (store *MatchStore) DeleteMatch(hash string) {
 
 	if match != nil {
 		match.Cancel()
+		ReleaseJoinCode(match.JoinCode)
+	}
+	if err := ReleaseMatchOwnership(hash); err != nil {
+		LogRedisError("release_ownership", err)
+	}
+	if err := DeleteMatchState(hash); err != nil {
+		LogRedisError("delete_match_state", err)
+	}
+	if err := DeleteRoomState(hash); err != nil {
+		LogRedisError("delete_room_state", err)
 	}
 	LogMatchLifecycle(hash, "deleted", logrus.Fields{})
 }
 
+// drops the match from this node only, the owner key, join code and
+// snapshot stay for the node that owns it now
+func (store *MatchStore) UnloadMatch(hash string) {
+	store.mutex.Lock()
+	match := store.matches[hash]
+	delete(store.matches, hash)
+	store.mutex.Unlock()
+
+	if match != nil {
+		match.Cancel()
+	}
+	LogMatchLifecycle(hash, "unloaded", logrus.Fields{})
+}
+
+// persists the match to redis, logging instead of failing the caller
+func (store *MatchStore) SaveMatch(hash string) {
+	match, exists := store.GetMatch(hash)
+	if !exists {
+		return
+	}
+
+	if err := SaveMatchState(match); err != nil {
+		LogRedisError("save_match_state", err)
+	}
+}
+
 func GeneratePlayerID() (string, error) {
 	id, err := uuid.NewUUID()
 	if err != nil {
@@ -88,7 +232,7 @@ func GeneratePlayerID() (string, error) {
 	return id.String(), nil
 }
 
-func (store *MatchStore) SetConnection(hash string, playerID string, role string, conn *websocket.Conn) error {
+func (store *MatchStore) SetConnection(hash string, playerID string, role string, conn Connection) error {
 	match, exists := store.GetMatch(hash)
 	if !exists {
 		return fmt.Errorf("Match %s not found", hash)
@@ -97,6 +241,40 @@ func (store *MatchStore) SetConnection(hash string, playerID string, role string
 	match.mutex.Lock()
 	defer match.mutex.Unlock()
 
+	return attachConnection(match, playerID, role, conn)
+}
+
+// seats a new socket as host or guest, a seat that already has a player id
+// stays reserved for them even while they are disconnected
+func (store *MatchStore) ClaimSeat(hash string, conn Connection) (string, string, error) {
+	match, exists := store.GetMatch(hash)
+	if !exists {
+		return "", "", fmt.Errorf("Match %s not found", hash)
+	}
+
+	id, err := GeneratePlayerID()
+	if err != nil {
+		return "", "", err
+	}
+
+	match.mutex.Lock()
+	defer match.mutex.Unlock()
+
+	var role string
+	switch {
+	case match.HostID == "":
+		role = "host"
+	case match.GuestID == "":
+		role = "guest"
+	default:
+		return "", "", fmt.Errorf("Match %s is full", hash)
+	}
+	return role, id, attachConnection(match, id, role, conn)
+}
+
+// must be called with the match lock held
+func attachConnection(match *Match, playerID string, role string, conn Connection) error {
+	hash := match.Hash
 	switch role {
 	case "host":
 		match.HostConn = conn
@@ -106,6 +284,13 @@ func (store *MatchStore) SetConnection(hash string, playerID string, role string
 		match.GuestConn = conn
 		match.GuestID = playerID
 		LogWebSocketConnection(hash, role, playerID, true)
+	case "player":
+		player, found := match.Players[playerID]
+		if !found {
+			return fmt.Errorf("Player %s not part of match %s", playerID, hash)
+		}
+		player.Conn = conn
+		LogWebSocketConnection(hash, role, playerID, true)
 	default:
 		return fmt.Errorf("Invalid role: %s", role)
 	}
@@ -152,7 +337,11 @@ func (store *MatchStore) BroadcastToRoom(hash string, message interface{}) error
 	match.mutex.Lock()
 	defer match.mutex.Unlock()
 
-	recipientCount := 0
+	// anything missed while a socket is gone can be replayed from the outbox on reconnect
+	msg = sequenceMessage(match, msg)
+	frames := newFrameCache(msg)
+
+	recipientCount := len(match.Spectators) + connectedPlayerCount(match)
 	if match.HostConn != nil {
 		recipientCount++
 	}
@@ -161,72 +350,208 @@ func (store *MatchStore) BroadcastToRoom(hash string, message interface{}) error
 	}
 	LogBroadcastEvent(hash, "room_message", recipientCount)
 
+	// keep going after a failed write so one dead socket doesn't starve the rest of the room
+	var sendErr error
 	if match.HostConn != nil {
-		if err := match.HostConn.WriteMessage(websocket.TextMessage, msg); err != nil {
+		if err := frames.Write(match.HostConn); err != nil {
 			LogBroadcastError(hash, "host", err)
 			match.HostConn = nil
-			return fmt.Errorf("failed to send to host: %w", err)
+			sendErr = fmt.Errorf("failed to send to host: %w", err)
 		}
 	}
 	if match.GuestConn != nil {
-		if err := match.GuestConn.WriteMessage(websocket.TextMessage, msg); err != nil {
+		if err := frames.Write(match.GuestConn); err != nil {
 			LogBroadcastError(hash, "guest", err)
 			match.GuestConn = nil
-			return fmt.Errorf("failed to send to guest: %w", err)
+			if sendErr == nil {
+				sendErr = fmt.Errorf("failed to send to guest: %w", err)
+			}
+		}
+	}
+	for id, player := range match.Players {
+		if player.Conn == nil {
+			continue
+		}
+		if err := frames.Write(player.Conn); err != nil {
+			LogBroadcastError(hash, "player", err)
+			player.Conn = nil
+			if sendErr == nil {
+				sendErr = fmt.Errorf("failed to send to player %s: %w", id, err)
+			}
 		}
 	}
+	writeToSpectators(match, frames)
 
+	return sendErr
+}
+
+// must be called with the match lock held
+func writeToSpectators(match *Match, frames *frameCache) {
+	for id, spectator := range match.Spectators {
+		if err := frames.Write(spectator.Conn); err != nil {
+			LogBroadcastError(match.Hash, "spectator", err)
+			delete(match.Spectators, id)
+		}
+	}
+}
+
+func (store *MatchStore) BroadcastToSpectators(hash string, message interface{}) error {
+	match, exists := store.GetMatch(hash)
+	if !exists {
+		return fmt.Errorf("Match %s not found", hash)
+	}
+
+	msg, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	match.mutex.Lock()
+	defer match.mutex.Unlock()
+
+	LogBroadcastEvent(hash, "spectator_message", len(match.Spectators))
+	writeToSpectators(match, newFrameCache(msg))
 	return nil
 }
 
-func (store *MatchStore) GetGameState(hash string) (*GameState, bool) {
+func (store *MatchStore) AddSpectator(hash string, conn Connection) (string, error) {
+	match, exists := store.GetMatch(hash)
+	if !exists {
+		return "", fmt.Errorf("Match %s not found", hash)
+	}
+
+	id, err := GeneratePlayerID()
+	if err != nil {
+		return "", err
+	}
+
+	match.mutex.Lock()
+	defer match.mutex.Unlock()
+
+	if len(match.Spectators) >= MaxSpectators {
+		return "", fmt.Errorf("Match %s has too many spectators", hash)
+	}
+
+	match.Spectators[id] = &Spectator{
+		ID:       id,
+		Conn:     conn,
+		JoinedAt: time.Now(),
+	}
+	LogWebSocketConnection(hash, "spectator", id, true)
+	return id, nil
+}
+
+func (store *MatchStore) RemoveSpectator(hash string, conn Connection) {
 	match, exists := store.GetMatch(hash)
 	if !exists {
-		return nil, false
+		return
+	}
+
+	match.mutex.Lock()
+	defer match.mutex.Unlock()
+
+	for id, spectator := range match.Spectators {
+		if spectator.Conn == conn {
+			delete(match.Spectators, id)
+			LogWebSocketConnection(hash, "spectator", id, false)
+		}
+	}
+}
+
+func (store *MatchStore) IsSpectator(hash string, conn Connection) bool {
+	match, exists := store.GetMatch(hash)
+	if !exists {
+		return false
 	}
 
 	match.mutex.RLock()
 	defer match.mutex.RUnlock()
 
-	return &match.GameState, true
+	for _, spectator := range match.Spectators {
+		if spectator.Conn == conn {
+			return true
+		}
+	}
+	return false
 }
 
-func (store *MatchStore) SubmitAnswer(hash, playerID, countryCode, countryName string) error {
+func (store *MatchStore) SubmitAnswer(hash, playerID, countryCode, countryName string, pin *Coordinates) error {
 	match, exists := store.GetMatch(hash)
 	if !exists {
 		return fmt.Errorf("Match %s not found", hash)
 	}
 
+	defer store.SaveMatch(hash)
 	match.mutex.Lock()
 	defer match.mutex.Unlock()
 
+	if match.State != "playing" {
+		return fmt.Errorf("Match %s is not playing", hash)
+	}
 	roundNum := match.GameState.CurrentRound - 1
 	if roundNum < 0 || roundNum >= len(match.GameState.Rounds) {
 		return fmt.Errorf("Invalid round number %d for match %s", roundNum, hash)
 	}
 
 	round := &match.GameState.Rounds[roundNum]
+	// once the round is scored or out of time a late answer would never count
+	if round.Finished || IsRoundTimeUp(round) {
+		return fmt.Errorf("Round %d of match %s is over", roundNum+1, hash)
+	}
 	answer := &PlayerAnswer{
 		CountryCode: countryCode,
 		CountryName: countryName,
+		Pin:         pin,
 		SubmittedAt: time.Now(),
 	}
 
-	switch playerID {
-	case match.HostID:
-		round.HostGuess = answer
-	case match.GuestID:
-		round.GuestGuess = answer
-	default:
-		return fmt.Errorf("Player %s not part of match %s", playerID, hash)
+	var role string
+	if _, found := match.Players[playerID]; found {
+		if round.Guesses == nil {
+			round.Guesses = make(map[string]*PlayerAnswer)
+		}
+		round.Guesses[playerID] = answer
+		role = "player"
+	} else {
+		switch playerID {
+		case match.HostID:
+			round.HostGuess = answer
+			role = "host"
+		case match.GuestID:
+			round.GuestGuess = answer
+			role = "guest"
+		default:
+			return fmt.Errorf("Player %s not part of match %s", playerID, hash)
+		}
 	}
+	answerLatency.Observe(answer.SubmittedAt.Sub(round.StartedAt).Seconds())
 
-	LogPlayerAction(hash, playerID, "submit_answer", logrus.Fields{
+	// spectators see the guess only after a delay so streams can't be used to cheat
+	guess := SpectatorGuessPayload{
+		Type:        "spectator_guess",
+		RoundIndex:  roundNum + 1,
+		Role:        role,
+		PlayerID:    playerID,
+		CountryCode: countryCode,
+		CountryName: countryName,
+		Pin:         pin,
+		SubmittedAt: answer.SubmittedAt,
+	}
+	time.AfterFunc(match.Config.SpectatorDelay(), func() {
+		store.BroadcastToSpectators(hash, guess)
+	})
+
+	fields := logrus.Fields{
 		"round_number": roundNum + 1,
 		"country_code": countryCode,
 		"country_name": countryName,
 		"submitted_at": answer.SubmittedAt,
-	})
+	}
+	if pin != nil {
+		fields["pin_lat"] = pin.Lat
+		fields["pin_lon"] = pin.Lon
+	}
+	LogPlayerAction(hash, playerID, "submit_answer", fields)
 	return nil
 }
 
@@ -246,9 +571,12 @@ func (store *MatchStore) ShouldEndRound(hash string) (bool, error) {
 
 	round := &match.GameState.Rounds[roundNum]
 
-	bothAnswered := round.HostGuess != nil && round.GuestGuess != nil
 	timeUp := IsRoundTimeUp(round)
+	if match.IsMultiplayer() {
+		return allPlayersAnswered(match, round) || timeUp, nil
+	}
 
+	bothAnswered := round.HostGuess != nil && round.GuestGuess != nil
 	return bothAnswered || timeUp, nil
 }
 
@@ -261,6 +589,10 @@ func (store *MatchStore) EndRound(hash string) (*RoundResultPayload, error) {
 	var result *RoundResultPayload
 
 	match.mutex.Lock()
+	if match.State != "playing" {
+		match.mutex.Unlock()
+		return nil, fmt.Errorf("Match %s is not playing", hash)
+	}
 	roundNum := match.GameState.CurrentRound - 1
 	if roundNum < 0 || roundNum >= len(match.GameState.Rounds) {
 		match.mutex.Unlock()
@@ -272,55 +604,71 @@ func (store *MatchStore) EndRound(hash string) (*RoundResultPayload, error) {
 		match.mutex.Unlock()
 		return nil, fmt.Errorf("Round %d for match %s already finished", roundNum, hash)
 	}
+	roundDuration.Observe(time.Since(round.StartedAt).Seconds())
 
-	hostCorrect, guestCorrect := GetRoundResult(round)
-	if round.HostGuess != nil {
-		round.HostGuess.Correct = hostCorrect
-	}
-	if round.GuestGuess != nil {
-		round.GuestGuess.Correct = guestCorrect
-	}
+	if match.IsMultiplayer() {
+		result = endMultiplayerRound(match, round, roundNum)
+		match.mutex.Unlock()
 
-	if hostCorrect {
-		match.GameState.HostScore++
-	}
-	if guestCorrect {
-		match.GameState.GuestScore++
+		store.SaveMatch(hash)
+		return result, nil
 	}
 
-	round.Finished = true
+	ScoreAnswer(round, round.HostGuess, match.Config.ScoringMode)
+	ScoreAnswer(round, round.GuestGuess, match.Config.ScoringMode)
 
 	var hostAnswer *string
 	var guestAnswer *string
+	var hostDistance *float64
+	var guestDistance *float64
+	hostPoints := 0
+	guestPoints := 0
 
 	if round.HostGuess != nil {
 		ans := fmt.Sprintf("%s (%s)", round.HostGuess.CountryName, round.HostGuess.CountryCode)
 		hostAnswer = &ans
+		hostDistance = round.HostGuess.Distance
+		hostPoints = round.HostGuess.Points
 	}
 	if round.GuestGuess != nil {
 		ans := fmt.Sprintf("%s (%s)", round.GuestGuess.CountryName, round.GuestGuess.CountryCode)
 		guestAnswer = &ans
+		guestDistance = round.GuestGuess.Distance
+		guestPoints = round.GuestGuess.Points
 	}
 
+	match.GameState.HostScore += hostPoints
+	match.GameState.GuestScore += guestPoints
+
+	round.Finished = true
+
+	correctCoordinates := round.Coordinates
 	result = &RoundResultPayload{
-		Type:        "round_result",
-		RoundIndex:  roundNum + 1,
-		HostAnswer:  hostAnswer,
-		GuestAnswer: guestAnswer,
-		CorrectName: round.CountryName,
-		CorrectCode: round.CountryCode,
-		HostScore:   match.GameState.HostScore,
-		GuestScore:  match.GameState.GuestScore,
+		Type:               "round_result",
+		RoundIndex:         roundNum + 1,
+		HostAnswer:         hostAnswer,
+		GuestAnswer:        guestAnswer,
+		CorrectName:        round.CountryName,
+		CorrectCode:        round.CountryCode,
+		CorrectCoordinates: &correctCoordinates,
+		HostDistance:       hostDistance,
+		GuestDistance:      guestDistance,
+		HostPoints:         hostPoints,
+		GuestPoints:        guestPoints,
+		HostScore:          match.GameState.HostScore,
+		GuestScore:         match.GameState.GuestScore,
 	}
 
 	LogGameRound(hash, roundNum+1, "ended", logrus.Fields{
-		"host_correct":  hostCorrect,
-		"guest_correct": guestCorrect,
-		"host_score":    match.GameState.HostScore,
-		"guest_score":   match.GameState.GuestScore,
+		"scoring_mode": match.Config.ScoringMode,
+		"host_points":  hostPoints,
+		"guest_points": guestPoints,
+		"host_score":   match.GameState.HostScore,
+		"guest_score":  match.GameState.GuestScore,
 	})
 	match.mutex.Unlock()
 
+	store.SaveMatch(hash)
 	return result, nil
 }
 
@@ -333,15 +681,19 @@ func (store *MatchStore) StartNextRound(hash string) error {
 	var payload RoundStartPayload
 
 	match.mutex.Lock()
+	if match.State != "playing" {
+		match.mutex.Unlock()
+		return fmt.Errorf("Match %s is not playing", hash)
+	}
 	roundNum := match.GameState.CurrentRound
-	if roundNum >= 5 {
+	if roundNum >= len(match.GameState.Rounds) {
 		match.mutex.Unlock()
 		return fmt.Errorf("All rounds already played for match %s", hash)
 	}
 
 	round := &match.GameState.Rounds[roundNum]
 	round.StartedAt = time.Now()
-	round.EndTime = round.StartedAt.Add(30 * time.Second)
+	round.EndTime = round.StartedAt.Add(match.Config.RoundDuration())
 	match.GameState.CurrentRound++
 
 	payload = RoundStartPayload{
@@ -352,6 +704,7 @@ func (store *MatchStore) StartNextRound(hash string) error {
 	}
 	match.mutex.Unlock()
 
+	store.SaveMatch(hash)
 	LogGameRound(hash, roundNum+1, "started", logrus.Fields{
 		"image_url": round.ImageURL,
 		"end_time":  round.EndTime,
@@ -359,7 +712,13 @@ func (store *MatchStore) StartNextRound(hash string) error {
 	return store.BroadcastToRoom(hash, payload)
 }
 
-func (store *MatchStore) CanReconnect(hash string, playerID string) (string, bool) {
+// the seat a returning player holds, the token proves the player id is theirs,
+// an empty token is a version 1 reconnect that requireReconnectToken let through
+func (store *MatchStore) CanReconnect(hash string, playerID string, token string) (string, bool) {
+	if token != "" && !ValidReconnectToken(playerID, token) {
+		return "", false
+	}
+
 	match, exists := store.GetMatch(hash)
 	if !exists {
 		return "", false
@@ -374,41 +733,34 @@ func (store *MatchStore) CanReconnect(hash string, playerID string) (string, boo
 	if match.GuestID == playerID {
 		return "guest", true
 	}
+	if _, found := match.Players[playerID]; found {
+		return "player", true
+	}
 	return "", false
 }
 
-func (store *MatchStore) ReconnectPlayer(hash string, role string, conn *websocket.Conn) error {
-	match, exists := store.GetMatch(hash)
-	if !exists {
-		return fmt.Errorf("Match %s not found", hash)
-	}
+func (store *MatchStore) Hashes() []string {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
 
-	var playerID string
-	switch role {
-	case "host":
-		playerID = match.HostID
-	case "guest":
-		playerID = match.GuestID
+	hashes := make([]string, 0, len(store.matches))
+	for hash := range store.matches {
+		hashes = append(hashes, hash)
 	}
-
-	return store.SetConnection(hash, playerID, role, conn)
+	return hashes
 }
 
-func (store *MatchStore) GetWaitingRooms() []RoomStatePayload {
+func (store *MatchStore) CountByState(state string) int {
 	store.mutex.RLock()
 	defer store.mutex.RUnlock()
 
-	var rooms []RoomStatePayload
+	count := 0
 	for _, match := range store.matches {
-		if match.State == "waiting" {
-			playerCount := GetPlayerCount(match)
-			rooms = append(rooms, RoomStatePayload{
-				Type:        "room_state",
-				Hash:        match.Hash,
-				State:       match.State,
-				PlayerCount: playerCount,
-			})
+		match.mutex.RLock()
+		if match.State == state {
+			count++
 		}
+		match.mutex.RUnlock()
 	}
-	return rooms
+	return count
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// a 1v1 match in its first round, kept out of CreateMatch so nothing prefetches
+func newPlayingMatch(store *MatchStore, hash string) *Match {
+	match := &Match{
+		Hash:       hash,
+		HostID:     "host",
+		GuestID:    "guest",
+		State:      "playing",
+		Config:     DefaultMatchConfig(),
+		Spectators: make(map[string]*Spectator),
+		Players:    make(map[string]*Player),
+		GameState: GameState{
+			CurrentRound: 1,
+			Rounds: []Round{{
+				CountryCode: "FR",
+				StartedAt:   time.Now(),
+				EndTime:     time.Now().Add(time.Minute),
+			}},
+		},
+	}
+	store.matches[hash] = match
+	return match
+}
+
+func TestSubmitAnswer(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(match *Match)
+		playerID string
+		accepted bool
+	}{
+		{"open round", func(match *Match) {}, "host", true},
+		{"guest", func(match *Match) {}, "guest", true},
+		{"not in the match", func(match *Match) {}, "stranger", false},
+		{"round already scored", func(match *Match) { match.GameState.Rounds[0].Finished = true }, "host", false},
+		{"round out of time", func(match *Match) { match.GameState.Rounds[0].EndTime = time.Now().Add(-time.Second) }, "host", false},
+		{"match not started", func(match *Match) { match.State = "waiting" }, "host", false},
+		{"match finished", func(match *Match) { match.State = "finished" }, "host", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := NewMatchStore()
+			match := newPlayingMatch(store, "room")
+			test.setup(match)
+
+			err := store.SubmitAnswer("room", test.playerID, "FR", "France", nil)
+			if accepted := err == nil; accepted != test.accepted {
+				t.Fatalf("SubmitAnswer() = %v, want accepted %v", err, test.accepted)
+			}
+
+			guess := match.GameState.Rounds[0].HostGuess
+			if test.playerID == "guest" {
+				guess = match.GameState.Rounds[0].GuestGuess
+			}
+			if (guess != nil) != test.accepted {
+				t.Errorf("guess stored = %v, want %v", guess != nil, test.accepted)
+			}
+		})
+	}
+}
+
+func TestSubmitAnswerAfterScoringKeepsGuess(t *testing.T) {
+	store := NewMatchStore()
+	match := newPlayingMatch(store, "room")
+
+	if err := store.SubmitAnswer("room", "host", "FR", "France", nil); err != nil {
+		t.Fatalf("SubmitAnswer() error: %v", err)
+	}
+	match.GameState.Rounds[0].Finished = true
+
+	if err := store.SubmitAnswer("room", "host", "DE", "Germany", nil); err == nil {
+		t.Fatal("SubmitAnswer() accepted an answer for a scored round")
+	}
+	if guess := match.GameState.Rounds[0].HostGuess; guess.CountryCode != "FR" {
+		t.Errorf("scored guess changed to %s", guess.CountryCode)
+	}
+}
+
+func TestCanReconnect(t *testing.T) {
+	identitySigner = NewHMACHashVerifier("test-secret")
+
+	tests := []struct {
+		name     string
+		playerID string
+		token    string
+		role     string // empty when the seat is refused
+	}{
+		{"host with its token", "host", ReconnectToken("host"), "host"},
+		{"guest with its token", "guest", ReconnectToken("guest"), "guest"},
+		{"v1 reconnect without a token", "host", "", "host"},
+		{"someone else's token", "host", ReconnectToken("guest"), ""},
+		{"forged token", "guest", "forged", ""},
+		{"not in the match", "stranger", ReconnectToken("stranger"), ""},
+		{"not in the match without a token", "stranger", "", ""},
+	}
+
+	store := NewMatchStore()
+	newPlayingMatch(store, "room")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			role, ok := store.CanReconnect("room", test.playerID, test.token)
+			if ok != (test.role != "") || role != test.role {
+				t.Errorf("CanReconnect(%s) = %q, %v, want %q", test.playerID, role, ok, test.role)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// live socket counts, also reported by /status
+var activeGameConnections atomic.Int64
+var activeDiscoveryConnections atomic.Int64
+
+var (
+	matchesCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "geofinder_matches_created_total",
+		Help: "Matches created on this node.",
+	})
+	matchesFinished = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "geofinder_matches_finished_total",
+		Help: "Matches that played through their last round.",
+	})
+	matchesTimedOut = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "geofinder_matches_timed_out_total",
+		Help: "Matches that were not ready before the ready timeout.",
+	})
+	prefetchFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "geofinder_prefetch_failures_total",
+		Help: "Matches whose round images could not be prefetched.",
+	})
+	broadcastErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "geofinder_broadcast_errors_total",
+		Help: "Failed writes to client connections.",
+	}, []string{"role"})
+
+	imageFetchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "geofinder_image_fetch_duration_seconds",
+		Help:    "Latency of image provider requests.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"result"})
+	roundDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "geofinder_round_duration_seconds",
+		Help:    "Time from round start until the round ended.",
+		Buckets: []float64{1, 2.5, 5, 10, 15, 20, 30, 45, 60, 90, 120, 300},
+	})
+	answerLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "geofinder_answer_latency_seconds",
+		Help:    "Time from round start until a player submitted an answer.",
+		Buckets: []float64{0.5, 1, 2.5, 5, 10, 15, 20, 30, 45, 60, 90, 120, 300},
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "geofinder_game_connections",
+		Help: "Connected game websockets.",
+	}, func() float64 {
+		return float64(activeGameConnections.Load())
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "geofinder_matchmaking_queue_size",
+		Help: "Players waiting in this node's matchmaking queue.",
+	}, func() float64 {
+		return float64(matchmakingQueue.Size())
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "geofinder_discovery_connections",
+		Help: "Connected discovery websockets.",
+	}, func() float64 {
+		return float64(activeDiscoveryConnections.Load())
+	})
+)
+
+// fetches an image through the configured provider and records how long it took
+func timedGetImage() (ImageResponse, error) {
+	start := time.Now()
+	resp, err := imageProvider.GetImage()
+
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	imageFetchDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+func MetricsHandler() fiber.Handler {
+	return adaptor.HTTPHandler(promhttp.Handler())
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+const MaxOutboxSize int = 128
+
+// room messages that are kept for reconnecting clients, the rest is covered by the state in reconnect_ok
+var replayableMessages = map[string]bool{
+	"round_start":  true,
+	"round_result": true,
+	"game_end":     true,
+}
+
+// adds "seq" as the first field of an encoded json object
+func withSeq(msg []byte, seq int64) []byte {
+	if len(msg) < 2 || msg[0] != '{' {
+		return msg
+	}
+
+	stamped := fmt.Appendf(nil, `{"seq":%d`, seq)
+	if len(bytes.TrimSpace(msg[1:len(msg)-1])) > 0 {
+		stamped = append(stamped, ',')
+	}
+	return append(stamped, msg[1:]...)
+}
+
+// stamps a room message with the match's next sequence number and keeps it in
+// the outbox if it can be replayed, must be called with the match lock held
+func sequenceMessage(match *Match, msg []byte) []byte {
+	match.LastSeq++
+	stamped := withSeq(msg, match.LastSeq)
+
+	var message struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal(msg, &message)
+	if !replayableMessages[message.Type] {
+		return stamped
+	}
+
+	match.Outbox = append(match.Outbox, OutboxEntry{Seq: match.LastSeq, Type: message.Type, Data: stamped})
+	if len(match.Outbox) > MaxOutboxSize {
+		dropped := len(match.Outbox) - MaxOutboxSize
+		match.OutboxTrimmedSeq = match.Outbox[dropped-1].Seq
+		match.Outbox = match.Outbox[dropped:]
+	}
+	return stamped
+}
+
+// seats a returning player, sends reconnect_ok and then every kept message after
+// lastSeq, all under the match lock so no broadcast can slip in between
+func (store *MatchStore) ReconnectWithReplay(hash string, playerID string, role string, conn Connection, lastSeq int64) error {
+	match, exists := store.GetMatch(hash)
+	if !exists {
+		return fmt.Errorf("Match %s not found", hash)
+	}
+
+	match.mutex.Lock()
+	defer match.mutex.Unlock()
+
+	if err := attachConnection(match, playerID, role, conn); err != nil {
+		return err
+	}
+
+	var replay []OutboxEntry
+	for _, entry := range match.Outbox {
+		if entry.Seq > lastSeq {
+			replay = append(replay, entry)
+		}
+	}
+	// older messages may have been dropped from the outbox already
+	complete := lastSeq >= match.OutboxTrimmedSeq
+
+	if err := conn.WriteJSON(ReconnectOkPayload{
+		Type:           "reconnect_ok",
+		PlayerId:       playerID,
+		Role:           role,
+		RoomState:      match.State,
+		RoundCount:     match.Config.RoundCount,
+		GameState:      &match.GameState,
+		Seq:            match.LastSeq,
+		Replayed:       len(replay),
+		ReplayComplete: complete,
+	}); err != nil {
+		return err
+	}
+
+	for _, entry := range replay {
+		if err := conn.WriteMessage(websocket.TextMessage, entry.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
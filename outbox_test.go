@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestWithSeq(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		seq  int64
+		want string
+	}{
+		{"object", `{"type":"round_start"}`, 7, `{"seq":7,"type":"round_start"}`},
+		{"empty object", `{}`, 1, `{"seq":1}`},
+		{"empty object with space", `{ }`, 2, `{"seq":2 }`},
+		{"nested object", `{"type":"game_end","series":{"game":2}}`, 12, `{"seq":12,"type":"game_end","series":{"game":2}}`},
+		{"array is left alone", `[1,2]`, 3, `[1,2]`},
+		{"bare text is left alone", `pong`, 4, `pong`},
+		{"too short", `{`, 5, `{`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := string(withSeq([]byte(test.msg), test.seq)); got != test.want {
+				t.Errorf("withSeq(%s, %d) = %s, want %s", test.msg, test.seq, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSequenceMessage(t *testing.T) {
+	tests := []struct {
+		name       string
+		types      []string // the types of the messages broadcast, in order
+		lastSeq    int64
+		outbox     int
+		firstSeq   int64 // of the oldest kept message
+		trimmedSeq int64
+	}{
+		{"nothing replayable", []string{"players_update", "spectator_guess"}, 2, 0, 0, 0},
+		{"mixed", []string{"players_update", "round_start", "spectator_guess", "round_result"}, 4, 2, 2, 0},
+		{"exactly full", repeatType("round_result", MaxOutboxSize), int64(MaxOutboxSize), MaxOutboxSize, 1, 0},
+		{"one over", repeatType("round_result", MaxOutboxSize+1), int64(MaxOutboxSize + 1), MaxOutboxSize, 2, 1},
+		{"far over", repeatType("round_result", MaxOutboxSize+40), int64(MaxOutboxSize + 40), MaxOutboxSize, 41, 40},
+		{
+			"unreplayable messages still take a seq",
+			append([]string{"players_update", "players_update"}, repeatType("game_end", MaxOutboxSize+1)...),
+			int64(MaxOutboxSize + 3), MaxOutboxSize, 4, 3,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			match := &Match{}
+			for _, messageType := range test.types {
+				msg := fmt.Appendf(nil, `{"type":%q}`, messageType)
+				stamped := sequenceMessage(match, msg)
+				if want := fmt.Sprintf(`{"seq":%d,"type":%q}`, match.LastSeq, messageType); string(stamped) != want {
+					t.Fatalf("sequenceMessage() = %s, want %s", stamped, want)
+				}
+			}
+
+			if match.LastSeq != test.lastSeq {
+				t.Errorf("LastSeq = %d, want %d", match.LastSeq, test.lastSeq)
+			}
+			if len(match.Outbox) != test.outbox {
+				t.Fatalf("outbox has %d messages, want %d", len(match.Outbox), test.outbox)
+			}
+			if match.OutboxTrimmedSeq != test.trimmedSeq {
+				t.Errorf("OutboxTrimmedSeq = %d, want %d", match.OutboxTrimmedSeq, test.trimmedSeq)
+			}
+			if test.outbox == 0 {
+				return
+			}
+			if match.Outbox[0].Seq != test.firstSeq {
+				t.Errorf("oldest kept seq = %d, want %d", match.Outbox[0].Seq, test.firstSeq)
+			}
+			for i := 1; i < len(match.Outbox); i++ {
+				if match.Outbox[i].Seq <= match.Outbox[i-1].Seq {
+					t.Fatalf("outbox out of order at %d: %d after %d", i, match.Outbox[i].Seq, match.Outbox[i-1].Seq)
+				}
+			}
+			if last := match.Outbox[len(match.Outbox)-1]; last.Seq != match.LastSeq {
+				t.Errorf("newest kept seq = %d, want %d", last.Seq, match.LastSeq)
+			}
+		})
+	}
+}
+
+func repeatType(messageType string, count int) []string {
+	types := make([]string, count)
+	for i := range types {
+		types[i] = messageType
+	}
+	return types
+}
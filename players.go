@@ -0,0 +1,390 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var Teams = []string{"red", "blue"}
+
+func (match *Match) IsMultiplayer() bool {
+	return match.Config.Mode == "ffa" || match.Config.Mode == "teams"
+}
+
+func (match *Match) IsTeams() bool {
+	return match.Config.Mode == "teams"
+}
+
+// must be called with the match lock held
+func teamSizes(match *Match) map[string]int {
+	sizes := make(map[string]int)
+	for _, team := range Teams {
+		sizes[team] = 0
+	}
+	for _, player := range match.Players {
+		if player.Team != "" {
+			sizes[player.Team]++
+		}
+	}
+	return sizes
+}
+
+// the requested team if it has room, otherwise the smaller one
+func pickTeam(match *Match, requested string) (string, error) {
+	sizes := teamSizes(match)
+	perTeam := match.Config.MaxPlayers / len(Teams)
+
+	if size, valid := sizes[requested]; valid {
+		if size >= perTeam {
+			return "", fmt.Errorf("Team %s is full", requested)
+		}
+		return requested, nil
+	}
+
+	team := Teams[0]
+	for _, candidate := range Teams {
+		if sizes[candidate] < sizes[team] {
+			team = candidate
+		}
+	}
+	return team, nil
+}
+
+// seats a new player in an ffa or teams room, team is only a preference
+func (store *MatchStore) AddPlayer(hash string, conn Connection, team string) (string, int, string, error) {
+	match, exists := store.GetMatch(hash)
+	if !exists {
+		return "", 0, "", fmt.Errorf("Match %s not found", hash)
+	}
+
+	id, err := GeneratePlayerID()
+	if err != nil {
+		return "", 0, "", err
+	}
+
+	match.mutex.Lock()
+	defer match.mutex.Unlock()
+
+	if match.State != "waiting" {
+		return "", 0, "", fmt.Errorf("Match %s already started", hash)
+	}
+	if len(match.Players) >= match.Config.MaxPlayers {
+		return "", 0, "", fmt.Errorf("Match %s is full", hash)
+	}
+
+	if match.IsTeams() {
+		team, err = pickTeam(match, team)
+		if err != nil {
+			return "", 0, "", err
+		}
+	} else {
+		team = ""
+	}
+
+	taken := make(map[int]bool)
+	for _, player := range match.Players {
+		taken[player.Seat] = true
+	}
+	seat := 1
+	for taken[seat] {
+		seat++
+	}
+
+	match.Players[id] = &Player{
+		ID:       id,
+		Seat:     seat,
+		Team:     team,
+		Conn:     conn,
+		JoinedAt: time.Now(),
+	}
+	LogWebSocketConnection(hash, "player", id, true)
+	return id, seat, team, nil
+}
+
+// checks whether seat 1 may start the game with the players seated so far
+func CanStartMultiplayer(match *Match) error {
+	match.mutex.RLock()
+	defer match.mutex.RUnlock()
+
+	connected := connectedPlayerCount(match)
+	if !match.IsTeams() {
+		if connected < MinFFAPlayers {
+			return fmt.Errorf("Not enough players")
+		}
+		return nil
+	}
+
+	sizes := teamSizes(match)
+	for _, team := range Teams {
+		if sizes[team] == 0 {
+			return fmt.Errorf("Both teams need players")
+		}
+	}
+	if sizes[Teams[0]] != sizes[Teams[1]] {
+		return fmt.Errorf("Teams must be the same size")
+	}
+	if connected < len(match.Players) {
+		return fmt.Errorf("Waiting for players to reconnect")
+	}
+	return nil
+}
+
+func (store *MatchStore) RemovePlayerConnection(hash string, playerID string) error {
+	match, exists := store.GetMatch(hash)
+	if !exists {
+		return fmt.Errorf("Match %s not found", hash)
+	}
+
+	match.mutex.Lock()
+	defer match.mutex.Unlock()
+
+	player, found := match.Players[playerID]
+	if !found {
+		return fmt.Errorf("Player %s not part of match %s", playerID, hash)
+	}
+	player.Conn = nil
+	LogWebSocketConnection(hash, "player", playerID, false)
+	return nil
+}
+
+// finds the seat a socket currently holds, if any
+func (store *MatchStore) ConnectionRole(hash string, conn Connection) (string, string) {
+	match, exists := store.GetMatch(hash)
+	if !exists {
+		return "", ""
+	}
+
+	match.mutex.RLock()
+	defer match.mutex.RUnlock()
+
+	if match.HostConn == conn {
+		return "host", match.HostID
+	}
+	if match.GuestConn == conn {
+		return "guest", match.GuestID
+	}
+	for id, player := range match.Players {
+		if player.Conn == conn {
+			return "player", id
+		}
+	}
+	return "", ""
+}
+
+func (store *MatchStore) PlayerSeat(hash string, playerID string) (int, string) {
+	match, exists := store.GetMatch(hash)
+	if !exists {
+		return 0, ""
+	}
+
+	match.mutex.RLock()
+	defer match.mutex.RUnlock()
+
+	if player, found := match.Players[playerID]; found {
+		return player.Seat, player.Team
+	}
+	return 0, ""
+}
+
+// must be called with the match lock held
+func playersInfo(match *Match) []PlayerInfo {
+	players := make([]PlayerInfo, 0, len(match.Players))
+	for _, player := range match.Players {
+		players = append(players, PlayerInfo{
+			PlayerID:  player.ID,
+			Seat:      player.Seat,
+			Team:      player.Team,
+			Connected: player.Conn != nil,
+		})
+	}
+	sort.Slice(players, func(i, j int) bool {
+		return players[i].Seat < players[j].Seat
+	})
+	return players
+}
+
+func (store *MatchStore) BroadcastPlayers(hash string) error {
+	match, exists := store.GetMatch(hash)
+	if !exists {
+		return fmt.Errorf("Match %s not found", hash)
+	}
+
+	match.mutex.RLock()
+	payload := PlayersUpdatePayload{
+		Type:       "players_update",
+		Players:    playersInfo(match),
+		MaxPlayers: match.Config.MaxPlayers,
+	}
+	match.mutex.RUnlock()
+
+	return store.BroadcastToRoom(hash, payload)
+}
+
+// must be called with the match lock held
+func connectedPlayerCount(match *Match) int {
+	count := 0
+	for _, player := range match.Players {
+		if player.Conn != nil {
+			count++
+		}
+	}
+	return count
+}
+
+// every connected player has answered, disconnected players just time out
+func allPlayersAnswered(match *Match, round *Round) bool {
+	answered := 0
+	for id, player := range match.Players {
+		if _, found := round.Guesses[id]; found {
+			answered++
+		} else if player.Conn != nil {
+			return false
+		}
+	}
+	return answered > 0
+}
+
+// scores an ffa round, must be called with the match lock held
+func endMultiplayerRound(match *Match, round *Round, roundNum int) *RoundResultPayload {
+	if match.GameState.Scores == nil {
+		match.GameState.Scores = make(map[string]int)
+	}
+
+	results := make([]PlayerRoundResult, 0, len(match.Players))
+	for id, player := range match.Players {
+		result := PlayerRoundResult{
+			PlayerID: id,
+			Seat:     player.Seat,
+			Team:     player.Team,
+		}
+
+		if guess, found := round.Guesses[id]; found {
+			ScoreAnswer(round, guess, match.Config.ScoringMode)
+			answer := fmt.Sprintf("%s (%s)", guess.CountryName, guess.CountryCode)
+			result.Answer = &answer
+			result.Correct = guess.Correct
+			result.Distance = guess.Distance
+			result.Points = guess.Points
+			match.GameState.Scores[id] += guess.Points
+		}
+
+		result.Score = match.GameState.Scores[id]
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Seat < results[j].Seat
+	})
+
+	round.Finished = true
+
+	var teamResults []TeamRoundResult
+	if match.IsTeams() {
+		teamResults = scoreTeams(match, results)
+	}
+
+	correctCoordinates := round.Coordinates
+	LogGameRound(match.Hash, roundNum+1, "ended", logrus.Fields{
+		"scoring_mode": match.Config.ScoringMode,
+		"scores":       match.GameState.Scores,
+		"team_scores":  match.GameState.TeamScores,
+	})
+
+	return &RoundResultPayload{
+		Type:               "round_result",
+		RoundIndex:         roundNum + 1,
+		CorrectName:        round.CountryName,
+		CorrectCode:        round.CountryCode,
+		CorrectCoordinates: &correctCoordinates,
+		Results:            results,
+		TeamResults:        teamResults,
+	}
+}
+
+// adds each team's best or combined round points to its total, must be called with the match lock held
+func scoreTeams(match *Match, results []PlayerRoundResult) []TeamRoundResult {
+	if match.GameState.TeamScores == nil {
+		match.GameState.TeamScores = make(map[string]int)
+	}
+
+	teamResults := make([]TeamRoundResult, 0, len(Teams))
+	for _, team := range Teams {
+		teamResult := TeamRoundResult{Team: team}
+		best := -1
+		for _, result := range results {
+			if result.Team != team || result.Answer == nil {
+				continue
+			}
+			if result.Points > best {
+				best = result.Points
+				teamResult.BestPlayerID = result.PlayerID
+			}
+			if match.Config.TeamScoring == "combined" {
+				teamResult.Points += result.Points
+			}
+		}
+		if match.Config.TeamScoring != "combined" && best > 0 {
+			teamResult.Points = best
+		}
+
+		match.GameState.TeamScores[team] += teamResult.Points
+		teamResult.Score = match.GameState.TeamScores[team]
+		teamResults = append(teamResults, teamResult)
+	}
+	return teamResults
+}
+
+// ranks players by score, players with equal scores share a rank
+func GetStandings(match *Match) []Standing {
+	match.mutex.RLock()
+	defer match.mutex.RUnlock()
+
+	standings := make([]Standing, 0, len(match.Players))
+	for id, player := range match.Players {
+		standings = append(standings, Standing{
+			PlayerID: id,
+			Seat:     player.Seat,
+			Team:     player.Team,
+			Score:    match.GameState.Scores[id],
+		})
+	}
+	sort.Slice(standings, func(i, j int) bool {
+		if standings[i].Score != standings[j].Score {
+			return standings[i].Score > standings[j].Score
+		}
+		return standings[i].Seat < standings[j].Seat
+	})
+
+	for i := range standings {
+		if i > 0 && standings[i].Score == standings[i-1].Score {
+			standings[i].Rank = standings[i-1].Rank
+		} else {
+			standings[i].Rank = i + 1
+		}
+	}
+	return standings
+}
+
+// the team with the higher total, or "tie"
+func GetTeamWinner(teamScores map[string]int) string {
+	red, blue := teamScores[Teams[0]], teamScores[Teams[1]]
+	if red > blue {
+		return Teams[0]
+	} else if blue > red {
+		return Teams[1]
+	}
+	return "tie"
+}
+
+// the player id of the sole leader, or "tie" if the top spot is shared
+func GetStandingsWinner(standings []Standing) string {
+	if len(standings) == 0 {
+		return "tie"
+	}
+	if len(standings) > 1 && standings[1].Rank == 1 {
+		return "tie"
+	}
+	return standings[0].PlayerID
+}
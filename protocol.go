@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// machine readable codes of error replies
+const (
+	ErrInvalidMessage = "invalid_message" // the frame is not an event envelope
+	ErrInvalidPayload = "invalid_payload" // data is not an object
+	ErrMissingField   = "missing_field"
+	ErrInvalidField   = "invalid_field"
+	ErrUnknownEvent   = "unknown_event"
+	ErrMatchNotFound  = "match_not_found"
+	ErrMatchFull      = "match_full"
+	ErrAccessDenied   = "access_denied"
+	ErrNotAllowed     = "not_allowed"
+	ErrInvalidState   = "invalid_state"
+	ErrInternal       = "internal_error"
+
+	ErrUnsupportedVersion = "unsupported_version"
+)
+
+func (err *ProtocolError) Error() string {
+	return err.Message
+}
+
+func NewProtocolError(code string, message string) *ProtocolError {
+	return &ProtocolError{Code: code, Message: message}
+}
+
+func missingField(field string) *ProtocolError {
+	return &ProtocolError{Code: ErrMissingField, Message: "Missing " + field, Field: field}
+}
+
+func invalidField(field string, message string) *ProtocolError {
+	return &ProtocolError{Code: ErrInvalidField, Message: message, Field: field}
+}
+
+// event payloads that check their fields after decoding
+type Validator interface {
+	Validate() *ProtocolError
+}
+
+func sendError(conn Connection, event string, id json.RawMessage, err *ProtocolError) error {
+	return conn.WriteJSON(ErrorPayload{
+		Type:    "error",
+		ID:      id,
+		Event:   event,
+		Code:    err.Code,
+		Message: err.Message,
+		Field:   err.Field,
+	})
+}
+
+// decodes an event's data into its payload type, a missing or null data is an
+// empty payload and anything other than an object is rejected
+func decodePayload(data json.RawMessage, payload interface{}) *ProtocolError {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		data = []byte("{}")
+	}
+	if data[0] != '{' {
+		return NewProtocolError(ErrInvalidPayload, "data must be an object")
+	}
+
+	if err := json.Unmarshal(data, payload); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			return invalidField(typeErr.Field, fmt.Sprintf("%s cannot be a %s", typeErr.Field, typeErr.Value))
+		}
+		return NewProtocolError(ErrInvalidPayload, "invalid payload")
+	}
+
+	if validator, ok := payload.(Validator); ok {
+		return validator.Validate()
+	}
+	return nil
+}
+
+// wraps a handler that takes a typed payload, the payload is decoded and
+// validated before the handler runs
+func Handle[T any](handler func(conn Connection, hash string, payload *T) *ProtocolError) EventHandler {
+	return func(conn Connection, hash string, data json.RawMessage) *ProtocolError {
+		payload := new(T)
+		if err := decodePayload(data, payload); err != nil {
+			return err
+		}
+		return handler(conn, hash, payload)
+	}
+}
+
+func (payload *SubmitAnswerRequest) Validate() *ProtocolError {
+	if (payload.Lat == nil) != (payload.Lon == nil) {
+		return invalidField("lat", "lat and lon must be sent together")
+	}
+	field := "lat"
+	if payload.PinObject != nil {
+		if payload.Lat != nil {
+			return invalidField("pin", "Send either pin or lat and lon")
+		}
+		if payload.PinObject.Lat == nil || payload.PinObject.Lon == nil {
+			return invalidField("pin", "pin needs lat and lon")
+		}
+		field = "pin"
+	}
+	pin := payload.Pin()
+	if pin != nil && !IsValidPin(pin) {
+		return invalidField(field, "Invalid coordinates")
+	}
+	if payload.CountryCode == "" && pin == nil {
+		return missingField("countryCode")
+	}
+	return nil
+}
+
+// the pin from either the pin object or the top-level lat and lon
+func (payload *SubmitAnswerRequest) Pin() *Coordinates {
+	if payload.PinObject != nil && payload.PinObject.Lat != nil && payload.PinObject.Lon != nil {
+		return &Coordinates{Lat: *payload.PinObject.Lat, Lon: *payload.PinObject.Lon}
+	}
+	if payload.Lat == nil || payload.Lon == nil {
+		return nil
+	}
+	return &Coordinates{Lat: *payload.Lat, Lon: *payload.Lon}
+}
+
+func (payload *SetPasswordRequest) Validate() *ProtocolError {
+	if payload.Password == "" {
+		return missingField("password")
+	}
+	if len(payload.Password) > MaxRoomPasswordLength {
+		return invalidField("password", fmt.Sprintf("password must be at most %d bytes", MaxRoomPasswordLength))
+	}
+	return nil
+}
+
+func (payload *ReconnectRequest) Validate() *ProtocolError {
+	if payload.PlayerID == "" {
+		return missingField("playerId")
+	}
+	return nil
+}
+
+// version 1 clients predate reconnect tokens and still get their seat back
+// with the player id alone, from version 2 on the token is required
+func requireReconnectToken(conn Connection, hash string, playerID string, token string) *ProtocolError {
+	if token != "" {
+		return nil
+	}
+	if protocolConn, ok := conn.(*ProtocolConn); !ok || protocolConn.Version() >= 2 {
+		return missingField("token")
+	}
+	LogPlayerAction(hash, playerID, "reconnect_without_token", logrus.Fields{
+		"deprecated": true,
+	})
+	return nil
+}
+
+func (payload *RematchRequest) Validate() *ProtocolError {
+	if payload.BestOf == 0 {
+		payload.BestOf = DefaultSeriesBestOf
+	}
+	if payload.BestOf < 1 || payload.BestOf > MaxSeriesBestOf || payload.BestOf%2 == 0 {
+		return invalidField("bestOf", fmt.Sprintf("bestOf must be odd and at most %d", MaxSeriesBestOf))
+	}
+	return nil
+}
+
+func (payload *JoinQueueRequest) Validate() *ProtocolError {
+	region, ok := normalizeRegion(payload.Region)
+	if !ok {
+		return invalidField("region", fmt.Sprintf("region must be at most %d characters", MaxRegionLength))
+	}
+	payload.Region = region
+	return nil
+}
+
+func (payload *HelloRequest) Validate() *ProtocolError {
+	if payload.Version == 0 {
+		return missingField("version")
+	}
+	if payload.MinVersion == 0 {
+		payload.MinVersion = payload.Version
+	}
+	if payload.MinVersion > payload.Version {
+		return invalidField("minVersion", "minVersion cannot be above version")
+	}
+	return nil
+}
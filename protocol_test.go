@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDecodePayload(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		code  string // empty when the payload decodes
+		field string
+	}{
+		{"missing data", "", "", ""},
+		{"null data", "null", "", ""},
+		{"empty object", "{}", "", ""},
+		{"padded object", "  {\"team\":\"red\"} ", "", ""},
+		{"array", "[]", ErrInvalidPayload, ""},
+		{"string", "\"auth\"", ErrInvalidPayload, ""},
+		{"broken json", "{\"team\":", ErrInvalidPayload, ""},
+		{"wrong field type", "{\"team\":5}", ErrInvalidField, "team"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var payload AuthRequest
+			err := decodePayload(json.RawMessage(test.data), &payload)
+			if test.code == "" {
+				if err != nil {
+					t.Fatalf("decodePayload(%q) = %v, want no error", test.data, err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("decodePayload(%q) accepted the payload, want %s", test.data, test.code)
+			}
+			if err.Code != test.code || err.Field != test.field {
+				t.Errorf("decodePayload(%q) = %s on %q, want %s on %q", test.data, err.Code, err.Field, test.code, test.field)
+			}
+		})
+	}
+}
+
+func TestSubmitAnswerRequest(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		code  string
+		field string
+		pin   *Coordinates
+	}{
+		{"country only", `{"countryCode":"FR"}`, "", "", nil},
+		{"top-level pin", `{"lat":48.85,"lon":2.35}`, "", "", &Coordinates{Lat: 48.85, Lon: 2.35}},
+		{"pin object", `{"pin":{"lat":48.85,"lon":2.35}}`, "", "", &Coordinates{Lat: 48.85, Lon: 2.35}},
+		{"pin object and country", `{"countryCode":"FR","pin":{"lat":0,"lon":0}}`, "", "", &Coordinates{}},
+		{"null pin", `{"countryCode":"FR","pin":null}`, "", "", nil},
+		{"nothing", `{}`, ErrMissingField, "countryCode", nil},
+		{"lat without lon", `{"lat":48.85}`, ErrInvalidField, "lat", nil},
+		{"pin object without lon", `{"pin":{"lat":48.85}}`, ErrInvalidField, "pin", nil},
+		{"empty pin object", `{"countryCode":"FR","pin":{}}`, ErrInvalidField, "pin", nil},
+		{"pin object and top-level pin", `{"pin":{"lat":1,"lon":1},"lat":1,"lon":1}`, ErrInvalidField, "pin", nil},
+		{"top-level pin out of range", `{"lat":91,"lon":0}`, ErrInvalidField, "lat", nil},
+		{"pin object out of range", `{"pin":{"lat":0,"lon":-181}}`, ErrInvalidField, "pin", nil},
+		{"pin not an object", `{"pin":[1,2]}`, ErrInvalidField, "pin", nil},
+		{"pin lat not a number", `{"pin":{"lat":"1","lon":2}}`, ErrInvalidField, "pin.lat", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var payload SubmitAnswerRequest
+			err := decodePayload(json.RawMessage(test.data), &payload)
+			if test.code != "" {
+				if err == nil {
+					t.Fatalf("decodePayload(%s) accepted the answer, want %s", test.data, test.code)
+				}
+				if err.Code != test.code || err.Field != test.field {
+					t.Errorf("decodePayload(%s) = %s on %q, want %s on %q", test.data, err.Code, err.Field, test.code, test.field)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodePayload(%s) = %v, want no error", test.data, err)
+			}
+
+			pin := payload.Pin()
+			switch {
+			case (pin == nil) != (test.pin == nil):
+				t.Errorf("Pin() = %v, want %v", pin, test.pin)
+			case pin != nil && *pin != *test.pin:
+				t.Errorf("Pin() = %v, want %v", *pin, *test.pin)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload Validator
+		field   string // empty when the payload is valid
+	}{
+		{"reconnect", &ReconnectRequest{PlayerID: "p", Token: "t"}, ""},
+		{"reconnect without a player", &ReconnectRequest{Token: "t"}, "playerId"},
+		{"reconnect without a token", &ReconnectRequest{PlayerID: "p"}, ""},
+		{"rematch with the default length", &RematchRequest{}, ""},
+		{"rematch best of 5", &RematchRequest{BestOf: 5}, ""},
+		{"rematch best of 4", &RematchRequest{BestOf: 4}, "bestOf"},
+		{"rematch too long", &RematchRequest{BestOf: MaxSeriesBestOf + 2}, "bestOf"},
+		{"hello", &HelloRequest{Version: 2}, ""},
+		{"hello without a version", &HelloRequest{}, "version"},
+		{"hello with minVersion above version", &HelloRequest{Version: 1, MinVersion: 2}, "minVersion"},
+		{"password", &SetPasswordRequest{Password: "hunter2"}, ""},
+		{"empty password", &SetPasswordRequest{}, "password"},
+		{"long password", &SetPasswordRequest{Password: strings.Repeat("x", MaxRoomPasswordLength+1)}, "password"},
+		{"join queue anywhere", &JoinQueueRequest{}, ""},
+		{"join queue in a region", &JoinQueueRequest{Region: strings.Repeat("x", MaxRegionLength)}, ""},
+		{"join queue in a long region", &JoinQueueRequest{Region: strings.Repeat("x", MaxRegionLength+1)}, "region"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.payload.Validate()
+			switch {
+			case test.field == "" && err != nil:
+				t.Errorf("Validate() = %v, want no error", err)
+			case test.field != "" && err == nil:
+				t.Errorf("Validate() accepted the payload, want an error on %q", test.field)
+			case test.field != "" && err.Field != test.field:
+				t.Errorf("Validate() failed on %q, want %q", err.Field, test.field)
+			}
+		})
+	}
+
+	// defaults filled in by Validate
+	rematch := &RematchRequest{}
+	rematch.Validate()
+	if rematch.BestOf != DefaultSeriesBestOf {
+		t.Errorf("rematch bestOf defaulted to %d, want %d", rematch.BestOf, DefaultSeriesBestOf)
+	}
+	join := &JoinQueueRequest{Region: "EU-West"}
+	join.Validate()
+	if join.Region != "eu-west" {
+		t.Errorf("join queue region normalized to %q, want eu-west", join.Region)
+	}
+	hello := &HelloRequest{Version: 2}
+	hello.Validate()
+	if hello.MinVersion != 2 {
+		t.Errorf("hello minVersion defaulted to %d, want 2", hello.MinVersion)
+	}
+}
+
+func TestRequireReconnectToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int // 0 skips hello
+		token   string
+		allowed bool
+	}{
+		{"v1 with a token", 0, "t", true},
+		{"v1 without a token", 0, "", true},
+		{"v1 from hello without a token", 1, "", true},
+		{"v2 with a token", 2, "t", true},
+		{"v2 without a token", 2, "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := NewProtocolConn(nil)
+			if test.version != 0 {
+				if _, err := conn.Negotiate(&HelloRequest{Version: test.version, MinVersion: test.version}); err != nil {
+					t.Fatalf("Negotiate() error: %v", err)
+				}
+			}
+
+			err := requireReconnectToken(conn, "room", "p", test.token)
+			switch {
+			case test.allowed && err != nil:
+				t.Errorf("requireReconnectToken() = %v, want no error", err)
+			case !test.allowed && (err == nil || err.Field != "token"):
+				t.Errorf("requireReconnectToken() = %v, want a missing token", err)
+			}
+		})
+	}
+}
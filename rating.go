@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+const DefaultRating int = 1500
+const RatingK float64 = 32
+
+const ratingsKey = "geofinder:ratings"
+
+type RatingRepository interface {
+	// returns a fresh DefaultRating entry for unknown accounts
+	GetRating(accountID string) (PlayerRating, error)
+	// reads the accounts' ratings, lets apply work out the new ones and saves
+	// them in one step, apply may run more than once if another node got in between
+	UpdateRatings(accountIDs []string, apply func([]PlayerRating) []PlayerRating) error
+}
+
+// keeps ratings in process, for local development only
+type MemoryRatingRepository struct {
+	mutex   sync.RWMutex
+	ratings map[string]PlayerRating
+}
+
+// keeps every account's rating as JSON in one redis hash
+type RedisRatingRepository struct {
+	Client *redis.Client
+}
+
+func NewMemoryRatingRepository() *MemoryRatingRepository {
+	return &MemoryRatingRepository{ratings: make(map[string]PlayerRating)}
+}
+
+func NewRedisRatingRepository(client *redis.Client) *RedisRatingRepository {
+	return &RedisRatingRepository{Client: client}
+}
+
+func newPlayerRating(accountID string) PlayerRating {
+	return PlayerRating{
+		AccountID: accountID,
+		Rating:    DefaultRating,
+	}
+}
+
+func (repo *MemoryRatingRepository) GetRating(accountID string) (PlayerRating, error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+
+	if rating, found := repo.ratings[accountID]; found {
+		return rating, nil
+	}
+	return newPlayerRating(accountID), nil
+}
+
+func (repo *MemoryRatingRepository) UpdateRatings(accountIDs []string, apply func([]PlayerRating) []PlayerRating) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	ratings := make([]PlayerRating, len(accountIDs))
+	for i, accountID := range accountIDs {
+		rating, found := repo.ratings[accountID]
+		if !found {
+			rating = newPlayerRating(accountID)
+		}
+		ratings[i] = rating
+	}
+	for _, rating := range apply(ratings) {
+		repo.ratings[rating.AccountID] = rating
+	}
+	return nil
+}
+
+func (repo *RedisRatingRepository) GetRating(accountID string) (PlayerRating, error) {
+	ctx := context.Background()
+	data, err := repo.Client.HGet(ctx, ratingsKey, accountID).Result()
+	if err == redis.Nil {
+		return newPlayerRating(accountID), nil
+	}
+	if err != nil {
+		return PlayerRating{}, err
+	}
+
+	var rating PlayerRating
+	if err := json.Unmarshal([]byte(data), &rating); err != nil {
+		return PlayerRating{}, err
+	}
+	return rating, nil
+}
+
+// how often a rating update is retried when another write beats it
+const ratingUpdateAttempts = 10
+
+// watches the ratings hash so a concurrent update from another node aborts
+// the transaction and we read again instead of overwriting it
+func (repo *RedisRatingRepository) UpdateRatings(accountIDs []string, apply func([]PlayerRating) []PlayerRating) error {
+	ctx := context.Background()
+	update := func(tx *redis.Tx) error {
+		values, err := tx.HMGet(ctx, ratingsKey, accountIDs...).Result()
+		if err != nil {
+			return err
+		}
+
+		ratings := make([]PlayerRating, len(accountIDs))
+		for i, value := range values {
+			ratings[i] = newPlayerRating(accountIDs[i])
+			if data, ok := value.(string); ok {
+				if err := json.Unmarshal([]byte(data), &ratings[i]); err != nil {
+					return err
+				}
+			}
+		}
+
+		updated := apply(ratings)
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, rating := range updated {
+				data, err := json.Marshal(rating)
+				if err != nil {
+					return err
+				}
+				pipe.HSet(ctx, ratingsKey, rating.AccountID, data)
+			}
+			return nil
+		})
+		return err
+	}
+
+	for range ratingUpdateAttempts {
+		err := repo.Client.Watch(ctx, update, ratingsKey)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return fmt.Errorf("Ratings kept changing, gave up after %d attempts", ratingUpdateAttempts)
+}
+
+// picks the rating store from RATINGS ("redis", "memory" or "none")
+func NewRatingRepositoryFromEnv() (RatingRepository, error) {
+	switch os.Getenv("RATINGS") {
+	case "", "redis":
+		if redisClient == nil && os.Getenv("RATINGS") == "" {
+			// a single node without redis keeps ratings until it restarts
+			return NewMemoryRatingRepository(), nil
+		}
+		if redisClient == nil {
+			return nil, fmt.Errorf("redis is required for redis ratings")
+		}
+		return NewRedisRatingRepository(redisClient), nil
+	case "memory":
+		return NewMemoryRatingRepository(), nil
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown RATINGS: %s", os.Getenv("RATINGS"))
+	}
+}
+
+type ratingParticipant struct {
+	playerID  string
+	accountID string
+	group     string // players in the same group don't play against each other
+	placement int    // 1 is best
+}
+
+func expectedScore(rating int, opponent int) float64 {
+	return 1 / (1 + math.Pow(10, float64(opponent-rating)/400))
+}
+
+// placements for everyone who played, taken from the winner and standings in game_end
+func ratingParticipants(match *Match, gameEnd GameEndPayload) []ratingParticipant {
+	match.mutex.RLock()
+	defer match.mutex.RUnlock()
+
+	var participants []ratingParticipant
+	switch {
+	case match.IsTeams():
+		for id, player := range match.Players {
+			placement := 1
+			if gameEnd.Winner != "tie" && gameEnd.Winner != player.Team {
+				placement = 2
+			}
+			participants = append(participants, ratingParticipant{id, match.Accounts[id], player.Team, placement})
+		}
+	case match.IsMultiplayer():
+		for _, standing := range gameEnd.Standings {
+			participants = append(participants, ratingParticipant{standing.PlayerID, match.Accounts[standing.PlayerID], standing.PlayerID, standing.Rank})
+		}
+	default:
+		if match.HostID == "" || match.GuestID == "" {
+			return nil
+		}
+		hostPlacement, guestPlacement := 1, 1
+		switch gameEnd.Winner {
+		case "host":
+			guestPlacement = 2
+		case "guest":
+			hostPlacement = 2
+		}
+		participants = []ratingParticipant{
+			{match.HostID, match.Accounts[match.HostID], match.HostID, hostPlacement},
+			{match.GuestID, match.Accounts[match.GuestID], match.GuestID, guestPlacement},
+		}
+	}
+	return participants
+}
+
+// applies elo to every pair of opponents, ratings line up with participants,
+// returns the new ratings and the changes for everyone who had an opponent
+func applyElo(participants []ratingParticipant, ratings []PlayerRating, now time.Time) ([]PlayerRating, []RatingChange) {
+	topGroups := make(map[string]bool)
+	for _, participant := range participants {
+		if participant.placement == 1 {
+			topGroups[participant.group] = true
+		}
+	}
+
+	updatedRatings := make([]PlayerRating, 0, len(participants))
+	changes := make([]RatingChange, 0, len(participants))
+	for i, participant := range participants {
+		var actual, expected float64
+		opponents := 0
+		for j, opponent := range participants {
+			if i == j || participant.group == opponent.group {
+				continue
+			}
+			opponents++
+			expected += expectedScore(ratings[i].Rating, ratings[j].Rating)
+			switch {
+			case participant.placement < opponent.placement:
+				actual += 1
+			case participant.placement == opponent.placement:
+				actual += 0.5
+			}
+		}
+		if opponents == 0 {
+			continue
+		}
+
+		delta := int(math.Round(RatingK * (actual - expected) / float64(opponents)))
+		updated := ratings[i]
+		updated.Rating += delta
+		updated.Games++
+		switch {
+		case participant.placement != 1:
+			updated.Losses++
+		case len(topGroups) == 1:
+			updated.Wins++
+		default:
+			updated.Draws++
+		}
+		updated.UpdatedAt = now
+		updatedRatings = append(updatedRatings, updated)
+
+		changes = append(changes, RatingChange{
+			PlayerID:  participant.playerID,
+			AccountID: participant.accountID,
+			OldRating: ratings[i].Rating,
+			NewRating: updated.Rating,
+			Delta:     delta,
+		})
+	}
+	return updatedRatings, changes
+}
+
+// applies elo to the match and saves the new ratings, returns nil if the match is unrated
+func UpdateRatings(match *Match, gameEnd GameEndPayload) []RatingChange {
+	if ratingRepository == nil {
+		return nil
+	}
+
+	match.mutex.RLock()
+	played := match.GameState.CurrentRound > 0
+	match.mutex.RUnlock()
+	if !played {
+		return nil
+	}
+
+	participants := ratingParticipants(match, gameEnd)
+	if len(participants) < 2 {
+		return nil
+	}
+	seen := make(map[string]bool)
+	for _, participant := range participants {
+		// one account in two seats can't rate itself
+		if participant.accountID == "" || seen[participant.accountID] {
+			return nil
+		}
+		seen[participant.accountID] = true
+	}
+
+	accountIDs := make([]string, len(participants))
+	for i, participant := range participants {
+		accountIDs[i] = participant.accountID
+	}
+
+	var changes []RatingChange
+	err := ratingRepository.UpdateRatings(accountIDs, func(ratings []PlayerRating) []PlayerRating {
+		var updated []PlayerRating
+		updated, changes = applyElo(participants, ratings, time.Now())
+		return updated
+	})
+	if err != nil {
+		LogMatchEvent(match.Hash, "rating_error", logrus.Fields{
+			"error": err.Error(),
+		})
+		return nil
+	}
+
+	LogMatchEvent(match.Hash, "ratings_updated", logrus.Fields{
+		"changes": len(changes),
+	})
+	return changes
+}
+
+// the current rating of an account, DefaultRating when ratings are off or unavailable
+func AccountRating(accountID string) int {
+	if ratingRepository == nil {
+		return DefaultRating
+	}
+	rating, err := ratingRepository.GetRating(accountID)
+	if err != nil {
+		return DefaultRating
+	}
+	return rating.Rating
+}
+
+func handleAccountRating(c *fiber.Ctx) error {
+	if ratingRepository == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Ratings disabled"})
+	}
+
+	rating, err := ratingRepository.GetRating(c.Params("accountId"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(rating)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestApplyElo(t *testing.T) {
+	type result struct {
+		delta, wins, losses, draws int
+	}
+
+	tests := []struct {
+		name         string
+		participants []ratingParticipant
+		ratings      []int
+		want         []result // one per participant that had an opponent
+	}{
+		{
+			name: "1v1 win between equals",
+			participants: []ratingParticipant{
+				{"host", "a", "host", 1},
+				{"guest", "b", "guest", 2},
+			},
+			ratings: []int{1500, 1500},
+			want:    []result{{16, 1, 0, 0}, {-16, 0, 1, 0}},
+		},
+		{
+			name: "1v1 tie between equals",
+			participants: []ratingParticipant{
+				{"host", "a", "host", 1},
+				{"guest", "b", "guest", 1},
+			},
+			ratings: []int{1500, 1500},
+			want:    []result{{0, 0, 0, 1}, {0, 0, 0, 1}},
+		},
+		{
+			name: "1v1 upset",
+			participants: []ratingParticipant{
+				{"host", "a", "host", 1},
+				{"guest", "b", "guest", 2},
+			},
+			ratings: []int{1400, 1600},
+			want:    []result{{24, 1, 0, 0}, {-24, 0, 1, 0}},
+		},
+		{
+			name: "teams don't rate teammates",
+			participants: []ratingParticipant{
+				{"r1", "a", "red", 1},
+				{"r2", "b", "red", 1},
+				{"b1", "c", "blue", 2},
+				{"b2", "d", "blue", 2},
+			},
+			ratings: []int{1500, 1500, 1500, 1500},
+			want:    []result{{16, 1, 0, 0}, {16, 1, 0, 0}, {-16, 0, 1, 0}, {-16, 0, 1, 0}},
+		},
+		{
+			name: "ffa placements",
+			participants: []ratingParticipant{
+				{"p1", "a", "p1", 1},
+				{"p2", "b", "p2", 2},
+				{"p3", "c", "p3", 3},
+			},
+			ratings: []int{1500, 1500, 1500},
+			want:    []result{{16, 1, 0, 0}, {0, 0, 1, 0}, {-16, 0, 1, 0}},
+		},
+		{
+			name: "ffa shared first place",
+			participants: []ratingParticipant{
+				{"p1", "a", "p1", 1},
+				{"p2", "b", "p2", 1},
+				{"p3", "c", "p3", 3},
+			},
+			ratings: []int{1500, 1500, 1500},
+			want:    []result{{8, 0, 0, 1}, {8, 0, 0, 1}, {-16, 0, 1, 0}},
+		},
+		{
+			name: "nobody to play against",
+			participants: []ratingParticipant{
+				{"r1", "a", "red", 1},
+				{"r2", "b", "red", 1},
+			},
+			ratings: []int{1500, 1500},
+			want:    []result{},
+		},
+	}
+
+	now := time.Now()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ratings := make([]PlayerRating, len(test.participants))
+			for i, participant := range test.participants {
+				ratings[i] = PlayerRating{AccountID: participant.accountID, Rating: test.ratings[i], Games: 3}
+			}
+
+			updated, changes := applyElo(test.participants, ratings, now)
+			if len(updated) != len(test.want) || len(changes) != len(test.want) {
+				t.Fatalf("applyElo() returned %d ratings and %d changes, want %d", len(updated), len(changes), len(test.want))
+			}
+
+			for i, want := range test.want {
+				rating, change := updated[i], changes[i]
+				if change.Delta != want.delta || change.NewRating-change.OldRating != want.delta {
+					t.Errorf("%s: delta %d (%d -> %d), want %d", change.PlayerID, change.Delta, change.OldRating, change.NewRating, want.delta)
+				}
+				if rating.AccountID != change.AccountID || rating.Rating != change.NewRating {
+					t.Errorf("%s: saved %s at %d, change says %s at %d", change.PlayerID, rating.AccountID, rating.Rating, change.AccountID, change.NewRating)
+				}
+				if rating.Games != 4 || rating.Wins != want.wins || rating.Losses != want.losses || rating.Draws != want.draws {
+					t.Errorf("%s: games %d, w/l/d %d/%d/%d, want 4 and %d/%d/%d", change.PlayerID, rating.Games, rating.Wins, rating.Losses, rating.Draws, want.wins, want.losses, want.draws)
+				}
+				if !rating.UpdatedAt.Equal(now) {
+					t.Errorf("%s: UpdatedAt %v, want %v", change.PlayerID, rating.UpdatedAt, now)
+				}
+			}
+		})
+	}
+}
+
+func TestExpectedScore(t *testing.T) {
+	tests := []struct {
+		rating, opponent int
+		want             float64
+	}{
+		{1500, 1500, 0.5},
+		{1900, 1500, 10.0 / 11},
+		{1500, 1900, 1.0 / 11},
+	}
+
+	for _, test := range tests {
+		if got := expectedScore(test.rating, test.opponent); got-test.want > 1e-9 || test.want-got > 1e-9 {
+			t.Errorf("expectedScore(%d, %d) = %v, want %v", test.rating, test.opponent, got, test.want)
+		}
+	}
+}
@@ -7,26 +7,32 @@ import (
 	"strings"
 	"time"
 
-	"github.com/gofiber/websocket/v2"
 	"github.com/redis/go-redis/v9"
 	"github.com/sirupsen/logrus"
 )
 
+// nil when redis was unreachable at startup, the node then runs alone and
+// keeps matches, join codes, tournaments and the matchmaking queue in memory
 var redisClient *redis.Client
 
 func InitRedis() error {
 	redisAddr := os.Getenv("REDIS_URL")
 	redisAddr = strings.TrimPrefix(redisAddr, "redis://")
-	redisClient = redis.NewClient(&redis.Options{
+	client := redis.NewClient(&redis.Options{
 		Addr: redisAddr,
 		DB:   0,
 	})
 	ctx := context.Background()
-	err := redisClient.Ping(ctx).Err()
+	err := client.Ping(ctx).Err()
 	if err != nil {
 		LogRedisError("connect", err)
+		client.Close()
+		LogWithFields(logrus.Fields{
+			"event": "redis_unavailable",
+		}).Warn("Redis unreachable, running as a single node")
 		return err
 	}
+	redisClient = client
 
 	LogWithFields(logrus.Fields{
 		"event": "redis_connected",
@@ -34,12 +40,38 @@ func InitRedis() error {
 	return nil
 }
 
-func PublishRoomState(hash string, state string, playerCount int) error {
-	payload := RoomStatePayload{
+// the discovery view of a match
+func roomState(match *Match) RoomStatePayload {
+	playerCount := GetPlayerCount(match)
+
+	match.mutex.RLock()
+	defer match.mutex.RUnlock()
+
+	return RoomStatePayload{
 		Type:        "room_state",
-		Hash:        hash,
-		State:       state,
+		Hash:        match.Hash,
+		State:       match.State,
 		PlayerCount: playerCount,
+		MaxPlayers:  match.Config.MaxPlayers,
+		Mode:        match.Config.Mode,
+		RoundCount:  match.Config.RoundCount,
+		Region:      match.Config.Region,
+		CreatedAt:   match.CreatedAt,
+	}
+}
+
+const roomsKey = "geofinder:rooms"
+
+// keeps the room listing in redis up to date and pushes the change to every
+// discovery subscriber, rooms that aren't listed are only kept for the admin list
+func PublishRoomState(match *Match) error {
+	payload := roomState(match)
+	listed := match.IsListed()
+	if redisClient != nil {
+		saveRoomState(payload, listed)
+	}
+	if !listed {
+		return nil
 	}
 
 	data, err := json.Marshal(payload)
@@ -47,6 +79,12 @@ func PublishRoomState(hash string, state string, playerCount int) error {
 		return err
 	}
 
+	// a single node is its own subscriber
+	if redisClient == nil {
+		forwardRoomUpdate(payload, data)
+		return nil
+	}
+
 	ctx := context.Background()
 	publishErr := redisClient.Publish(ctx, "geofinder:room_updates", data).Err()
 	if publishErr != nil {
@@ -57,7 +95,66 @@ func PublishRoomState(hash string, state string, playerCount int) error {
 	return publishErr
 }
 
+func saveRoomState(room RoomStatePayload, listed bool) {
+	data, err := json.Marshal(ClusterRoom{Room: room, Listed: listed, Node: nodeID})
+	if err != nil {
+		return
+	}
+
+	ctx := context.Background()
+	if err := redisClient.HSet(ctx, roomsKey, room.Hash, data).Err(); err != nil {
+		LogRedisError("save_room_state", err)
+	}
+}
+
+func DeleteRoomState(hash string) error {
+	if redisClient == nil {
+		return nil
+	}
+
+	ctx := context.Background()
+	return redisClient.HDel(ctx, roomsKey, hash).Err()
+}
+
+// the rooms of every node, rooms of nodes that died are dropped
+func ClusterRooms() []ClusterRoom {
+	if redisClient == nil {
+		return nil
+	}
+
+	ctx := context.Background()
+	entries, err := redisClient.HGetAll(ctx, roomsKey).Result()
+	if err != nil {
+		LogRedisError("cluster_rooms", err)
+		return nil
+	}
+
+	alive := make(map[string]bool)
+	rooms := make([]ClusterRoom, 0, len(entries))
+	for hash, data := range entries {
+		var room ClusterRoom
+		if err := json.Unmarshal([]byte(data), &room); err != nil {
+			redisClient.HDel(ctx, roomsKey, hash)
+			continue
+		}
+		if _, checked := alive[room.Node]; !checked {
+			nodeAlive, err := IsNodeAlive(room.Node)
+			alive[room.Node] = err != nil || nodeAlive
+		}
+		if !alive[room.Node] {
+			redisClient.HDel(ctx, roomsKey, hash)
+			continue
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
 func StorePlayerIDs(hash string, hostID, guestID string) error {
+	if redisClient == nil {
+		return nil
+	}
+
 	data := map[string]string{
 		"hostID":  hostID,
 		"guestID": guestID,
@@ -72,6 +169,10 @@ func StorePlayerIDs(hash string, hostID, guestID string) error {
 }
 
 func GetPlayerIDs(hash string) (string, string, error) {
+	if redisClient == nil {
+		return "", "", redis.Nil
+	}
+
 	ctx := context.Background()
 	data, err := redisClient.Get(ctx, "geofinder:match:"+hash+":players").Result()
 	if err != nil {
@@ -86,6 +187,76 @@ func GetPlayerIDs(hash string) (string, string, error) {
 	return result.HostID, result.GuestID, err
 }
 
+const matchStateTTL = 1 * time.Hour
+
+func matchStateKey(hash string) string {
+	return "geofinder:match:" + hash + ":state"
+}
+
+// writes the full match state to redis so other nodes (and restarts) can see it
+func SaveMatchState(match *Match) error {
+	if redisClient == nil {
+		return nil
+	}
+
+	match.mutex.RLock()
+	data, err := json.Marshal(MatchSnapshot{
+		Hash:         match.Hash,
+		HostID:       match.HostID,
+		GuestID:      match.GuestID,
+		Players:      match.Players,
+		Accounts:     match.Accounts,
+		JoinCode:     match.JoinCode,
+		PasswordHash: match.PasswordHash,
+		PasswordSalt: match.PasswordSalt,
+		Series:       match.Series,
+		RematchHash:  match.RematchHash,
+		Tournament:   match.TournamentID,
+		BracketMatch: match.BracketMatchID,
+		LastSeq:      match.LastSeq,
+		Outbox:       match.Outbox,
+		TrimmedSeq:   match.OutboxTrimmedSeq,
+		State:        match.State,
+		Seed:         match.Seed,
+		CreatedAt:    match.CreatedAt,
+		GameReady:    match.GameReady,
+		Config:       match.Config,
+		GameState:    match.GameState,
+		Owner:        nodeID,
+		SavedAt:      time.Now(),
+	})
+	match.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	return redisClient.Set(ctx, matchStateKey(match.Hash), data, matchStateTTL).Err()
+}
+
+func LoadMatchState(hash string) (*MatchSnapshot, error) {
+	ctx := context.Background()
+	data, err := redisClient.Get(ctx, matchStateKey(hash)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot MatchSnapshot
+	if err := json.Unmarshal([]byte(data), &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+func DeleteMatchState(hash string) error {
+	if redisClient == nil {
+		return nil
+	}
+
+	ctx := context.Background()
+	return redisClient.Del(ctx, matchStateKey(hash)).Err()
+}
+
 func SubscribeToRoomUpdates(ctx context.Context) {
 	pubsub := redisClient.Subscribe(ctx, "geofinder:room_updates")
 	defer pubsub.Close()
@@ -96,19 +267,24 @@ func SubscribeToRoomUpdates(ctx context.Context) {
 	for msg := range ch {
 		LogRedisMessage("geofinder:room_updates", msg.Payload)
 
-		// Broadcast to all discovery connections
-		discoveryMutex.RLock()
-		connections := make([]*websocket.Conn, len(discoveryConnections))
-		copy(connections, discoveryConnections)
-		discoveryMutex.RUnlock()
-
-		for _, conn := range connections {
-			if conn != nil {
-				err := conn.WriteMessage(websocket.TextMessage, []byte(msg.Payload))
-				if err != nil {
-					LogBroadcastError("", "discovery_client", err)
-				}
-			}
+		var room RoomStatePayload
+		if err := json.Unmarshal([]byte(msg.Payload), &room); err != nil {
+			continue
+		}
+		forwardRoomUpdate(room, []byte(msg.Payload))
+	}
+}
+
+// forwards a room update to the discovery connections whose filter cares about the room
+func forwardRoomUpdate(room RoomStatePayload, data []byte) {
+	discoveryMutex.RLock()
+	subscribers := make([]*DiscoverySubscriber, len(discoveryConnections))
+	copy(subscribers, discoveryConnections)
+	discoveryMutex.RUnlock()
+
+	for _, subscriber := range subscribers {
+		if err := subscriber.Offer(room, data); err != nil {
+			LogBroadcastError(room.Hash, "discovery_client", err)
 		}
 	}
 }
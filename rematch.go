@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const DefaultSeriesBestOf int = 3
+const MaxSeriesBestOf int = 9
+
+// the series key of a game_end winner, empty on a tie
+func seriesWinnerKey(match *Match, winner string) string {
+	switch {
+	case winner == "tie":
+		return ""
+	case match.IsMultiplayer():
+		return winner
+	case winner == "host":
+		return match.HostID
+	case winner == "guest":
+		return match.GuestID
+	}
+	return ""
+}
+
+// adds a finished game to its series, must be called with the match lock held
+func applySeriesResult(series *SeriesState, key string) {
+	if key == "" {
+		series.Draws++
+	} else {
+		series.Wins[key]++
+		if series.Wins[key] > series.BestOf/2 {
+			series.Winner = key
+		}
+	}
+}
+
+// records the game_end winner on the match's series, returns a copy for game_end or nil outside a series
+func recordSeriesResult(match *Match, winner string) *SeriesState {
+	match.mutex.Lock()
+	defer match.mutex.Unlock()
+
+	match.GameState.Winner = winner
+	if match.Series == nil {
+		return nil
+	}
+
+	applySeriesResult(match.Series, seriesWinnerKey(match, winner))
+	series := *match.Series
+	series.Wins = maps.Clone(match.Series.Wins)
+	series.Hashes = slices.Clone(match.Series.Hashes)
+	return &series
+}
+
+// the players that have to agree before a rematch starts, must be called with the match lock held
+func rematchVoters(match *Match) []string {
+	if !match.IsMultiplayer() {
+		if match.HostConn == nil || match.GuestConn == nil {
+			return nil
+		}
+		return []string{match.HostID, match.GuestID}
+	}
+
+	var voters []string
+	for id, player := range match.Players {
+		if player.Conn != nil {
+			voters = append(voters, id)
+		}
+	}
+	if len(voters) < 2 {
+		return nil
+	}
+	return voters
+}
+
+// counts a player's vote for a rematch, once every voter agreed the next match
+// hash is reserved and returned
+func (store *MatchStore) VoteRematch(hash string, playerID string, bestOf int, accept bool) (RematchVotePayload, string, error) {
+	match, exists := store.GetMatch(hash)
+	if !exists {
+		return RematchVotePayload{}, "", fmt.Errorf("Match %s not found", hash)
+	}
+
+	match.mutex.Lock()
+	defer match.mutex.Unlock()
+
+	if match.State != "finished" {
+		return RematchVotePayload{}, "", fmt.Errorf("Match %s is not finished", hash)
+	}
+	if match.RematchHash != "" {
+		return RematchVotePayload{}, match.RematchHash, nil
+	}
+
+	voters := rematchVoters(match)
+	if !slices.Contains(voters, playerID) {
+		return RematchVotePayload{}, "", fmt.Errorf("Rematch needs every player connected")
+	}
+	if accept && len(match.RematchVotes) == 0 {
+		return RematchVotePayload{}, "", fmt.Errorf("No rematch requested")
+	}
+
+	if match.RematchVotes == nil {
+		match.RematchVotes = make(map[string]bool)
+		match.RematchBestOf = bestOf
+	}
+	match.RematchVotes[playerID] = true
+
+	votes := 0
+	for _, voter := range voters {
+		if match.RematchVotes[voter] {
+			votes++
+		}
+	}
+
+	payload := RematchVotePayload{
+		Type:     "rematch_requested",
+		PlayerID: playerID,
+		Votes:    votes,
+		Required: len(voters),
+		BestOf:   match.RematchBestOf,
+	}
+	if votes < len(voters) {
+		return payload, "", nil
+	}
+
+	match.RematchHash = IssueRoomHash("rm-")
+	return payload, match.RematchHash, nil
+}
+
+// opens the next match of the series with the same players, seats and settings
+func (store *MatchStore) CreateRematch(hash string, nextHash string) (*SeriesState, error) {
+	previous, exists := store.GetMatch(hash)
+	if !exists {
+		return nil, fmt.Errorf("Match %s not found", hash)
+	}
+
+	previous.mutex.RLock()
+	config := previous.Config
+	hostID := previous.HostID
+	guestID := previous.GuestID
+	players := make(map[string]*Player, len(previous.Players))
+	for id, player := range previous.Players {
+		if player.Conn == nil {
+			continue
+		}
+		players[id] = &Player{
+			ID:       id,
+			Seat:     player.Seat,
+			Team:     player.Team,
+			JoinedAt: player.JoinedAt,
+		}
+	}
+	accounts := maps.Clone(previous.Accounts)
+
+	// a decided series, or none yet, starts over counting the previous game as game 1
+	var series SeriesState
+	if previous.Series != nil && previous.Series.Winner == "" {
+		series = *previous.Series
+		series.Wins = maps.Clone(previous.Series.Wins)
+		series.Hashes = slices.Clone(previous.Series.Hashes)
+	} else {
+		series = SeriesState{
+			ID:     uuid.NewString(),
+			BestOf: previous.RematchBestOf,
+			Wins:   make(map[string]int),
+			Hashes: []string{hash},
+			Game:   1,
+		}
+		applySeriesResult(&series, seriesWinnerKey(previous, previous.GameState.Winner))
+	}
+	previous.mutex.RUnlock()
+
+	// the seats belong to the previous players, so the room is never listed for strangers
+	if config.Visibility != "private" {
+		config.Visibility = "unlisted"
+	}
+
+	series.Game++
+	series.Hashes = append(series.Hashes, nextHash)
+
+	if _, err := ClaimMatchOwnership(nextHash); err != nil {
+		LogRedisError("claim_ownership", err)
+	}
+	match := store.CreateMatch(nextHash, config)
+
+	match.mutex.Lock()
+	match.HostID = hostID
+	match.GuestID = guestID
+	match.Players = players
+	match.Accounts = accounts
+	match.Series = &series
+	match.mutex.Unlock()
+	store.SaveMatch(nextHash)
+
+	LogMatchLifecycle(nextHash, "rematch_created", logrus.Fields{
+		"previous_hash": hash,
+		"series_id":     series.ID,
+		"series_game":   series.Game,
+		"best_of":       series.BestOf,
+	})
+	return &series, nil
+}
+
+// handles rematch_request and rematch_accept, which only differ in that accepting needs a pending request
+func handleRematchVote(conn Connection, hash string, bestOf int, accept bool) *ProtocolError {
+	_, playerID := matchStore.ConnectionRole(hash, conn)
+	vote, nextHash, err := matchStore.VoteRematch(hash, playerID, bestOf, accept)
+	if err != nil {
+		return NewProtocolError(ErrInvalidState, err.Error())
+	}
+
+	if vote.Type != "" {
+		LogPlayerAction(hash, playerID, "rematch_vote", logrus.Fields{
+			"votes":    vote.Votes,
+			"required": vote.Required,
+		})
+		matchStore.BroadcastToRoom(hash, vote)
+	}
+	if nextHash == "" {
+		return nil
+	}
+
+	// late votes after the rematch was created just get the hash again
+	if vote.Type == "" {
+		conn.WriteJSON(RematchStartPayload{
+			Type:         "rematch_start",
+			Hash:         nextHash,
+			PreviousHash: hash,
+		})
+		return nil
+	}
+
+	series, err := matchStore.CreateRematch(hash, nextHash)
+	if err != nil {
+		return NewProtocolError(ErrMatchNotFound, err.Error())
+	}
+	matchStore.BroadcastToRoom(hash, RematchStartPayload{
+		Type:         "rematch_start",
+		Hash:         nextHash,
+		PreviousHash: hash,
+		Series:       series,
+	})
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+// decodes a frame in the socket's encoding, text frames are always json
+func (session *GameSession) HandleFrame(messageType int, data []byte) {
+	switch messageType {
+	case websocket.TextMessage:
+		session.HandleMessage(data)
+	case websocket.BinaryMessage:
+		decoded, err := session.Conn.DecodeBinary(data)
+		if err != nil {
+			sendError(session.Conn, "", nil, NewProtocolError(ErrInvalidMessage, err.Error()))
+			return
+		}
+		session.HandleMessage(decoded)
+	}
+}
+
+// decodes one client frame and dispatches it to the router
+func (session *GameSession) HandleMessage(data []byte) {
+	var message struct {
+		ID    json.RawMessage `json:"id"` // optional, echoed in the ack or error
+		Event string          `json:"event"`
+		Data  json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(data, &message); err != nil || message.Event == "" {
+		sendError(session.Conn, "", message.ID, NewProtocolError(ErrInvalidMessage, "Expected an event and its data"))
+		return
+	}
+
+	// hello is about the socket rather than the match, so it never reaches the router
+	if message.Event == "hello" {
+		session.Conn.beginReply(message.Event, message.ID)
+		ok, err := session.hello(message.Data)
+		session.Conn.Reply(err)
+		if err == nil {
+			session.Conn.SetEncoding(ok.Encoding)
+		}
+		return
+	}
+
+	session.Router.Handle(session.Conn, session.Hash, message.Event, message.ID, message.Data)
+
+	// the seat is only known once auth or reconnect attached this socket to it
+	if session.Role == "" {
+		session.Role, session.PlayerID = matchStore.ConnectionRole(session.Hash, session.Conn)
+	}
+}
+
+// hello_ok still goes out as json, the negotiated encoding starts after it
+func (session *GameSession) hello(data json.RawMessage) (HelloOkPayload, *ProtocolError) {
+	var hello HelloRequest
+	if err := decodePayload(data, &hello); err != nil {
+		return HelloOkPayload{}, err
+	}
+
+	ok, err := session.Conn.Negotiate(&hello)
+	if err != nil {
+		return HelloOkPayload{}, err
+	}
+	session.Conn.WriteJSON(ok)
+	return ok, nil
+}
+
+func (session *GameSession) Close() {
+	matchStore.RemoveSpectator(session.Hash, session.Conn)
+	switch session.Role {
+	case "":
+	case "player":
+		matchStore.RemovePlayerConnection(session.Hash, session.PlayerID)
+		matchStore.BroadcastPlayers(session.Hash)
+	default:
+		matchStore.RemoveConnection(session.Hash, session.Role)
+	}
+
+	// a seat opened up, let discovery know
+	if match, exists := matchStore.GetMatch(session.Hash); exists && session.Role != "" && match.CurrentState() == "waiting" {
+		PublishRoomState(match)
+	}
+}
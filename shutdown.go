@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+	"github.com/sirupsen/logrus"
+)
+
+var draining atomic.Bool
+
+const DefaultDrainSeconds int = 25
+
+func drainDeadline() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("SHUTDOWN_DRAIN_SECONDS"))
+	if err != nil || seconds < 0 {
+		seconds = DefaultDrainSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// waits for SIGTERM/SIGINT, then drains the matches on this node and stops fiber
+func handleShutdown(ctx context.Context, app *fiber.App) {
+	<-ctx.Done()
+
+	deadline := drainDeadline()
+	draining.Store(true)
+	LogWithFields(logrus.Fields{
+		"event":          "shutdown_started",
+		"drain_seconds":  int64(deadline.Seconds()),
+		"active_matches": len(matchStore.Hashes()),
+	}).Info("Shutting down, draining matches")
+
+	notice := ServerDrainingPayload{
+		Type:     "server_draining",
+		Deadline: time.Now().Add(deadline),
+	}
+	for _, hash := range matchStore.Hashes() {
+		if err := matchStore.BroadcastToRoom(hash, notice); err != nil {
+			LogBroadcastError(hash, "drain_notice", err)
+		}
+	}
+
+	discoveryMutex.RLock()
+	for _, subscriber := range discoveryConnections {
+		subscriber.WriteJSON(notice)
+	}
+	discoveryMutex.RUnlock()
+
+	// let the matches that are already playing finish, up to the deadline
+	ticker := time.NewTicker(1 * time.Second)
+	timeout := time.After(deadline)
+wait:
+	for matchStore.CountByState("playing") > 0 {
+		select {
+		case <-ticker.C:
+		case <-timeout:
+			break wait
+		}
+	}
+	ticker.Stop()
+
+	// whatever is left gets snapshotted and handed back so another node can pick it up
+	remaining := matchStore.Hashes()
+	for _, hash := range remaining {
+		matchStore.SaveMatch(hash)
+		if err := ReleaseMatchOwnership(hash); err != nil {
+			LogRedisError("release_ownership", err)
+		}
+	}
+
+	LogWithFields(logrus.Fields{
+		"event":            "shutdown_drained",
+		"snapshot_matches": len(remaining),
+	}).Info("Matches drained")
+
+	if err := app.ShutdownWithTimeout(5 * time.Second); err != nil {
+		LogWithFields(logrus.Fields{
+			"event": "shutdown_error",
+			"error": err.Error(),
+		}).Error("Failed to shut down server")
+	}
+}
+
+// rejects new websocket upgrades once the server is draining
+func rejectWhileDraining(c *fiber.Ctx) error {
+	if draining.Load() {
+		return fiber.ErrServiceUnavailable
+	}
+	if websocket.IsWebSocketUpgrade(c) {
+		return c.Next()
+	}
+	return fiber.ErrUpgradeRequired
+}
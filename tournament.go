@@ -0,0 +1,638 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const MinTournamentPlayers int = 2
+const MaxTournamentPlayers int = 64
+const MaxTournamentBestOf int = 7
+
+const tournamentTTL = 24 * time.Hour
+
+// tournaments are advanced by the node that created them, redis keeps a copy
+// for reads from other nodes and for picking a bracket back up after failover
+type TournamentStore struct {
+	mutex       sync.RWMutex
+	tournaments map[string]*Tournament
+}
+
+var tournamentStore = &TournamentStore{tournaments: make(map[string]*Tournament)}
+
+type TournamentSubscriber struct {
+	Conn         *websocket.Conn
+	TournamentID string
+	mutex        sync.Mutex
+}
+
+var (
+	tournamentSubscribers []*TournamentSubscriber
+	tournamentMutex       sync.RWMutex
+)
+
+func tournamentKey(id string) string {
+	return "geofinder:tournament:" + id
+}
+
+// the smallest power of two that fits every player
+func bracketSize(players int) int {
+	size := 2
+	for size < players {
+		size *= 2
+	}
+	return size
+}
+
+// standard seeding, the top seeds only meet late: 1v8, 4v5, 2v7, 3v6
+func seedOrder(size int) []int {
+	order := []int{0}
+	for len(order) < size {
+		next := make([]int, 0, len(order)*2)
+		for _, seed := range order {
+			next = append(next, seed, len(order)*2-1-seed)
+		}
+		order = next
+	}
+	return order
+}
+
+func bracketMatchID(prefix string, round int, index int) string {
+	return fmt.Sprintf("%s%d-%d", prefix, round, index+1)
+}
+
+// builds the bracket for the players in seed order, byes go to the top seeds
+func NewTournament(players []string, format string, bestOf int, config MatchConfig) (*Tournament, error) {
+	if len(players) < MinTournamentPlayers || len(players) > MaxTournamentPlayers {
+		return nil, fmt.Errorf("Tournaments need %d to %d players", MinTournamentPlayers, MaxTournamentPlayers)
+	}
+	seen := make(map[string]bool)
+	for _, player := range players {
+		if player == "" || seen[player] {
+			return nil, fmt.Errorf("Player ids must be unique and not empty")
+		}
+		seen[player] = true
+	}
+	if format != "single" && format != "double" {
+		return nil, fmt.Errorf("Unknown tournament format %s", format)
+	}
+	if bestOf < 1 || bestOf > MaxTournamentBestOf || bestOf%2 == 0 {
+		return nil, fmt.Errorf("bestOf must be odd and at most %d", MaxTournamentBestOf)
+	}
+
+	size := bracketSize(len(players))
+	if format == "double" {
+		size = max(size, 4)
+	}
+	rounds := 0
+	for n := size; n > 1; n /= 2 {
+		rounds++
+	}
+
+	tournament := &Tournament{
+		ID:        uuid.NewString(),
+		Format:    format,
+		BestOf:    bestOf,
+		Players:   slices.Clone(players),
+		Config:    config,
+		Matches:   make(map[string]*BracketMatch),
+		State:     "playing",
+		CreatedAt: time.Now(),
+	}
+	add := func(match *BracketMatch) {
+		match.State = "pending"
+		tournament.Matches[match.ID] = match
+		tournament.Order = append(tournament.Order, match.ID)
+	}
+
+	seeds := seedOrder(size)
+	for round := 1; round <= rounds; round++ {
+		for i := range size >> round {
+			match := &BracketMatch{ID: bracketMatchID("W", round, i), Bracket: "winners", Round: round}
+			if round == 1 {
+				for seat := range 2 {
+					if seed := seeds[2*i+seat]; seed < len(players) {
+						match.Players[seat] = players[seed]
+					}
+				}
+				match.Resolved = 2
+			}
+			if round < rounds {
+				match.NextWin = &BracketSeat{Match: bracketMatchID("W", round+1, i/2), Seat: i % 2}
+			}
+			add(match)
+		}
+	}
+
+	if format == "double" {
+		// losers round m has size >> ((m+1)/2 + 1) matches, odd rounds pair up the
+		// survivors and even rounds take in the losers of the next winners round
+		loserRounds := 2 * (rounds - 1)
+		for round := 1; round <= loserRounds; round++ {
+			count := size >> ((round+1)/2 + 1)
+			for i := range count {
+				match := &BracketMatch{ID: bracketMatchID("L", round, i), Bracket: "losers", Round: round}
+				switch {
+				case round == loserRounds:
+					match.NextWin = &BracketSeat{Match: "GF", Seat: 1}
+				case round%2 == 1:
+					match.NextWin = &BracketSeat{Match: bracketMatchID("L", round+1, i), Seat: 0}
+				default:
+					match.NextWin = &BracketSeat{Match: bracketMatchID("L", round+1, i/2), Seat: i % 2}
+				}
+				add(match)
+			}
+		}
+
+		for round := 1; round <= rounds; round++ {
+			count := size >> round
+			for i := range count {
+				match := tournament.Matches[bracketMatchID("W", round, i)]
+				if round == 1 {
+					match.NextLose = &BracketSeat{Match: bracketMatchID("L", 1, i/2), Seat: i % 2}
+				} else {
+					// dropped in reversed so players do not meet the same opponent again right away
+					match.NextLose = &BracketSeat{Match: bracketMatchID("L", 2*(round-1), count-1-i), Seat: 1}
+				}
+			}
+		}
+
+		tournament.Matches[bracketMatchID("W", rounds, 0)].NextWin = &BracketSeat{Match: "GF", Seat: 0}
+		add(&BracketMatch{ID: "GF", Bracket: "final", Round: 1})
+		// only played if the losers bracket champion wins GF, see finish
+		add(&BracketMatch{ID: "GF2", Bracket: "final", Round: 2})
+	}
+
+	return tournament, nil
+}
+
+// opens the first round, must be called with the tournament lock held
+func (tournament *Tournament) start() {
+	for _, id := range slices.Clone(tournament.Order) {
+		if match := tournament.Matches[id]; match.Bracket == "winners" && match.Round == 1 {
+			tournament.settle(match)
+		}
+	}
+}
+
+// plays a bracket match once both seats are known, byes go straight through
+func (tournament *Tournament) settle(match *BracketMatch) {
+	if match.Resolved < 2 || match.State != "pending" {
+		return
+	}
+
+	a, b := match.Players[0], match.Players[1]
+	switch {
+	case a != "" && b != "":
+		tournament.startGame(match)
+	case a != "":
+		tournament.finish(match, a, "")
+	default:
+		tournament.finish(match, b, "")
+	}
+}
+
+// hands a player, or an empty seat for a bye, to the match a result feeds into
+func (tournament *Tournament) fillSeat(seat *BracketSeat, player string) {
+	match := tournament.Matches[seat.Match]
+	match.Players[seat.Seat] = player
+	match.Resolved++
+	tournament.settle(match)
+}
+
+func (tournament *Tournament) finish(match *BracketMatch, winner string, loser string) {
+	match.State = "finished"
+	match.Winner = winner
+	match.Loser = loser
+	match.Hash = ""
+
+	if match.NextLose != nil {
+		tournament.fillSeat(match.NextLose, loser)
+	}
+	if match.NextWin != nil {
+		tournament.fillSeat(match.NextWin, winner)
+		return
+	}
+
+	// nobody is out of a double elimination before their second loss, so a
+	// grand final lost by the winners bracket champion gets a reset match
+	if reset, found := tournament.Matches["GF2"]; found && match.ID == "GF" {
+		if loser != "" && loser == match.Players[0] {
+			reset.Players = match.Players
+			reset.Resolved = 2
+			tournament.settle(reset)
+			return
+		}
+		reset.State = "skipped"
+	}
+
+	tournament.State = "finished"
+	tournament.Champion = winner
+	LogTournamentEvent(tournament.ID, "finished", logrus.Fields{"champion": winner})
+}
+
+// opens the next game of a bracket match with its two players already seated
+func (tournament *Tournament) startGame(bracketMatch *BracketMatch) {
+	hash := IssueRoomHash("tr-")
+	if _, err := ClaimMatchOwnership(hash); err != nil {
+		LogRedisError("claim_ownership", err)
+	}
+
+	match := matchStore.CreateMatch(hash, tournament.Config)
+	match.mutex.Lock()
+	match.HostID = bracketMatch.Players[0]
+	match.GuestID = bracketMatch.Players[1]
+	match.TournamentID = tournament.ID
+	match.BracketMatchID = bracketMatch.ID
+	match.mutex.Unlock()
+	matchStore.SaveMatch(hash)
+
+	bracketMatch.State = "playing"
+	bracketMatch.Hash = hash
+	bracketMatch.Hashes = append(bracketMatch.Hashes, hash)
+	LogTournamentEvent(tournament.ID, "game_created", logrus.Fields{
+		"room_hash":     hash,
+		"bracket_match": bracketMatch.ID,
+		"game":          len(bracketMatch.Hashes),
+	})
+}
+
+func (store *TournamentStore) Add(tournament *Tournament) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.tournaments[tournament.ID] = tournament
+}
+
+func (store *TournamentStore) Remove(id string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.tournaments, id)
+}
+
+// finds a tournament, games of one bracket finish on any node so the redis
+// copy wins over the memory one whenever another node saved it since
+func (store *TournamentStore) Find(id string) *Tournament {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	cached, exists := store.tournaments[id]
+	if redisClient == nil {
+		return cached
+	}
+
+	tournament, err := LoadTournament(id)
+	if err != nil {
+		return cached
+	}
+	if exists {
+		cached.mutex.Lock()
+		cached.update(tournament)
+		cached.mutex.Unlock()
+		return cached
+	}
+	if tournament.State != "finished" {
+		store.tournaments[tournament.ID] = tournament
+	}
+	return tournament
+}
+
+// takes the bracket from a newer saved copy, must be called with the tournament lock held
+func (tournament *Tournament) update(saved *Tournament) {
+	if saved.Version <= tournament.Version {
+		return
+	}
+	tournament.Matches = saved.Matches
+	tournament.Order = saved.Order
+	tournament.State = saved.State
+	tournament.Champion = saved.Champion
+	tournament.Version = saved.Version
+}
+
+func LoadTournament(id string) (*Tournament, error) {
+	if redisClient == nil {
+		return nil, fmt.Errorf("Tournament %s not found", id)
+	}
+
+	ctx := context.Background()
+	data, err := redisClient.Get(ctx, tournamentKey(id)).Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	var tournament Tournament
+	if err := json.Unmarshal(data, &tournament); err != nil {
+		return nil, err
+	}
+	return &tournament, nil
+}
+
+// the bracket as anyone may see it, player ids are what the players take
+// their seats with so they show as seeds, and the game hashes are left out,
+// must be called with the tournament lock held
+func (tournament *Tournament) publicView() *Tournament {
+	label := func(player string) string {
+		if index := slices.Index(tournament.Players, player); player != "" && index >= 0 {
+			return fmt.Sprintf("seed %d", index+1)
+		}
+		return player
+	}
+
+	view := &Tournament{
+		ID:        tournament.ID,
+		Format:    tournament.Format,
+		BestOf:    tournament.BestOf,
+		Players:   make([]string, 0, len(tournament.Players)),
+		Config:    tournament.Config,
+		Matches:   make(map[string]*BracketMatch, len(tournament.Matches)),
+		Order:     slices.Clone(tournament.Order),
+		State:     tournament.State,
+		Champion:  label(tournament.Champion),
+		CreatedAt: tournament.CreatedAt,
+		Version:   tournament.Version,
+	}
+	for _, player := range tournament.Players {
+		view.Players = append(view.Players, label(player))
+	}
+	for id, match := range tournament.Matches {
+		public := *match
+		public.Players = [2]string{label(match.Players[0]), label(match.Players[1])}
+		public.Winner = label(match.Winner)
+		public.Loser = label(match.Loser)
+		public.Hash = ""
+		public.Hashes = nil
+		view.Matches[id] = &public
+	}
+	return view
+}
+
+// saves the bracket to redis and pushes its public view to every subscriber in the cluster
+func PublishTournament(tournament *Tournament) {
+	tournament.mutex.Lock()
+	tournament.Version++
+	state, err := json.Marshal(tournament)
+	view, _ := json.Marshal(tournament.publicView())
+	tournament.mutex.Unlock()
+	if err != nil {
+		return
+	}
+
+	data, _ := json.Marshal(struct {
+		Type       string          `json:"type"`
+		Tournament json.RawMessage `json:"tournament"`
+	}{"tournament_update", view})
+
+	// a single node keeps the bracket in memory and is its own subscriber
+	if redisClient == nil {
+		forwardTournamentUpdate(tournament.ID, data)
+		return
+	}
+
+	ctx := context.Background()
+	if err := redisClient.Set(ctx, tournamentKey(tournament.ID), state, tournamentTTL).Err(); err != nil {
+		LogRedisError("save_tournament", err)
+	}
+	if err := redisClient.Publish(ctx, "geofinder:tournament_updates", data).Err(); err != nil {
+		LogRedisError("publish", err)
+	}
+}
+
+func CreateTournament(players []string, format string, bestOf int, config MatchConfig) (*Tournament, error) {
+	tournament, err := NewTournament(players, format, bestOf, config)
+	if err != nil {
+		return nil, err
+	}
+
+	tournamentStore.Add(tournament)
+	LogTournamentEvent(tournament.ID, "created", logrus.Fields{
+		"format":  format,
+		"players": len(players),
+		"best_of": bestOf,
+	})
+
+	tournament.mutex.Lock()
+	tournament.start()
+	tournament.mutex.Unlock()
+	PublishTournament(tournament)
+	return tournament, nil
+}
+
+// moves the bracket on after a tournament game ended, ties and undecided series
+// get another game between the same players
+func AdvanceTournament(match *Match, winner string) {
+	match.mutex.RLock()
+	id, bracketMatchID, hash := match.TournamentID, match.BracketMatchID, match.Hash
+	match.mutex.RUnlock()
+	if id == "" {
+		return
+	}
+
+	tournament := tournamentStore.Find(id)
+	if tournament == nil {
+		LogTournamentEvent(id, "missing", logrus.Fields{"room_hash": hash})
+		return
+	}
+
+	tournament.mutex.Lock()
+	bracketMatch, found := tournament.Matches[bracketMatchID]
+	if !found || bracketMatch.Hash != hash || bracketMatch.State != "playing" {
+		tournament.mutex.Unlock()
+		return
+	}
+
+	switch winner {
+	case "host":
+		bracketMatch.Wins[0]++
+	case "guest":
+		bracketMatch.Wins[1]++
+	}
+	switch {
+	case bracketMatch.Wins[0] > tournament.BestOf/2:
+		tournament.finish(bracketMatch, bracketMatch.Players[0], bracketMatch.Players[1])
+	case bracketMatch.Wins[1] > tournament.BestOf/2:
+		tournament.finish(bracketMatch, bracketMatch.Players[1], bracketMatch.Players[0])
+	default:
+		tournament.startGame(bracketMatch)
+	}
+	finished := tournament.State == "finished"
+	tournament.mutex.Unlock()
+
+	PublishTournament(tournament)
+	// without redis the memory copy is the only one left
+	if finished && redisClient != nil {
+		tournamentStore.Remove(id)
+	}
+}
+
+// decides a bracket match without playing it, for no-shows
+func AwardBracketMatch(id string, bracketMatchID string, winner string) error {
+	tournament := tournamentStore.Find(id)
+	if tournament == nil {
+		return fmt.Errorf("Tournament %s not found", id)
+	}
+
+	tournament.mutex.Lock()
+	bracketMatch, found := tournament.Matches[bracketMatchID]
+	if !found {
+		tournament.mutex.Unlock()
+		return fmt.Errorf("Bracket match %s not found", bracketMatchID)
+	}
+	seat := slices.Index(bracketMatch.Players[:], winner)
+	if bracketMatch.State != "playing" || seat < 0 || winner == "" {
+		tournament.mutex.Unlock()
+		return fmt.Errorf("Player %s is not playing bracket match %s", winner, bracketMatchID)
+	}
+	hash := bracketMatch.Hash
+	tournament.finish(bracketMatch, winner, bracketMatch.Players[1-seat])
+	finished := tournament.State == "finished"
+	tournament.mutex.Unlock()
+
+	// the game no longer counts, so nobody should keep playing it
+	closeMatch(hash, "Bracket match decided by admin")
+	PublishTournament(tournament)
+	// without redis the memory copy is the only one left
+	if finished && redisClient != nil {
+		tournamentStore.Remove(id)
+	}
+	return nil
+}
+
+func handleTournament(c *fiber.Ctx) error {
+	id := c.Params("id")
+	tournament := tournamentStore.Find(id)
+	if tournament == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": fmt.Sprintf("Tournament %s not found", id)})
+	}
+
+	tournament.mutex.Lock()
+	defer tournament.mutex.Unlock()
+	return c.JSON(tournament.publicView())
+}
+
+// the game a player has to join right now, only for the player themselves
+func handleTournamentGame(c *fiber.Ctx) error {
+	id := c.Params("id")
+	tournament := tournamentStore.Find(id)
+	if tournament == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": fmt.Sprintf("Tournament %s not found", id)})
+	}
+
+	// the reconnect token goes in the Authorization header so it stays out of access logs
+	playerID := c.Query("playerId")
+	if !ValidReconnectToken(playerID, bearerToken(c)) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Invalid token"})
+	}
+
+	tournament.mutex.Lock()
+	defer tournament.mutex.Unlock()
+
+	for _, bracketID := range tournament.Order {
+		match := tournament.Matches[bracketID]
+		if match.State == "playing" && slices.Contains(match.Players[:], playerID) {
+			return c.JSON(fiber.Map{"bracketMatch": match.ID, "hash": match.Hash})
+		}
+	}
+	return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": fmt.Sprintf("Player %s has no game right now", playerID)})
+}
+
+func SubscribeToTournamentUpdates(ctx context.Context) {
+	pubsub := redisClient.Subscribe(ctx, "geofinder:tournament_updates")
+	defer pubsub.Close()
+
+	LogRedisSubscribe("geofinder:tournament_updates")
+
+	for msg := range pubsub.Channel() {
+		var update struct {
+			Tournament struct {
+				ID string `json:"id"`
+			} `json:"tournament"`
+		}
+		if err := json.Unmarshal([]byte(msg.Payload), &update); err != nil {
+			continue
+		}
+		forwardTournamentUpdate(update.Tournament.ID, []byte(msg.Payload))
+	}
+}
+
+// sends a tournament_update to the sockets watching that tournament
+func forwardTournamentUpdate(id string, data []byte) {
+	tournamentMutex.RLock()
+	subscribers := slices.Clone(tournamentSubscribers)
+	tournamentMutex.RUnlock()
+
+	for _, subscriber := range subscribers {
+		if subscriber.TournamentID != id {
+			continue
+		}
+		subscriber.mutex.Lock()
+		err := subscriber.Conn.WriteMessage(websocket.TextMessage, data)
+		subscriber.mutex.Unlock()
+		if err != nil {
+			LogBroadcastError("", "tournament_client", err)
+		}
+	}
+}
+
+func handleTournamentConnection(c *websocket.Conn) {
+	id := c.Query("id")
+	tournament := tournamentStore.Find(id)
+	if tournament == nil {
+		c.WriteJSON(map[string]interface{}{"type": "error", "message": fmt.Sprintf("Tournament %s not found", id)})
+		return
+	}
+
+	subscriber := &TournamentSubscriber{Conn: c, TournamentID: id}
+	tournamentMutex.Lock()
+	tournamentSubscribers = append(tournamentSubscribers, subscriber)
+	tournamentMutex.Unlock()
+
+	defer func() {
+		tournamentMutex.Lock()
+		for i, other := range tournamentSubscribers {
+			if other == subscriber {
+				tournamentSubscribers = append(tournamentSubscribers[:i], tournamentSubscribers[i+1:]...)
+				break
+			}
+		}
+		tournamentMutex.Unlock()
+	}()
+
+	subscriber.mutex.Lock()
+	tournament.mutex.Lock()
+	c.WriteJSON(TournamentUpdatePayload{Type: "tournament_update", Tournament: tournament.publicView()})
+	tournament.mutex.Unlock()
+	subscriber.mutex.Unlock()
+
+	for {
+		messageType, data, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+		if messageType != websocket.TextMessage {
+			continue
+		}
+
+		var message struct {
+			Event string `json:"event"`
+		}
+		json.Unmarshal(data, &message)
+
+		subscriber.mutex.Lock()
+		if message.Event == "ping" {
+			c.WriteMessage(websocket.TextMessage, []byte("pong"))
+		} else {
+			c.WriteMessage(websocket.TextMessage, []byte("Unknown event: "+message.Event))
+		}
+		subscriber.mutex.Unlock()
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestSeedOrder(t *testing.T) {
+	tests := []struct {
+		size int
+		want []int
+	}{
+		{1, []int{0}},
+		{2, []int{0, 1}},
+		{4, []int{0, 3, 1, 2}},
+		{8, []int{0, 7, 3, 4, 1, 6, 2, 5}},
+	}
+
+	for _, test := range tests {
+		if got := seedOrder(test.size); !slices.Equal(got, test.want) {
+			t.Errorf("seedOrder(%d) = %v, want %v", test.size, got, test.want)
+		}
+	}
+
+	// every seed once, and each first round pair adds up to the weakest seed
+	for _, size := range []int{16, 32, 64} {
+		order := seedOrder(size)
+		sorted := slices.Sorted(slices.Values(order))
+		for i, seed := range sorted {
+			if seed != i {
+				t.Fatalf("seedOrder(%d) is not a permutation: %v", size, order)
+			}
+		}
+		for i := 0; i < size; i += 2 {
+			if order[i]+order[i+1] != size-1 {
+				t.Errorf("seedOrder(%d) pairs %d with %d", size, order[i], order[i+1])
+			}
+		}
+	}
+}
+
+func TestNewTournamentRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		players []string
+		format  string
+		bestOf  int
+	}{
+		{"one player", []string{"a"}, "single", 1},
+		{"too many players", make([]string, MaxTournamentPlayers+1), "single", 1},
+		{"duplicate player", []string{"a", "b", "a"}, "single", 1},
+		{"empty player", []string{"a", ""}, "single", 1},
+		{"unknown format", []string{"a", "b"}, "swiss", 1},
+		{"even best of", []string{"a", "b"}, "single", 2},
+		{"best of too long", []string{"a", "b"}, "single", MaxTournamentBestOf + 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewTournament(test.players, test.format, test.bestOf, DefaultMatchConfig()); err == nil {
+				t.Errorf("NewTournament() accepted %v", test.players)
+			}
+		})
+	}
+}
+
+func TestNewTournamentBracket(t *testing.T) {
+	tests := []struct {
+		name    string
+		players int
+		format  string
+		winners int // matches in the winners bracket
+		losers  int
+		finals  int
+		byes    int // the top seeds get them
+	}{
+		{"single, two players", 2, "single", 1, 0, 0, 0},
+		{"single, full bracket", 8, "single", 7, 0, 0, 0},
+		{"single, with byes", 5, "single", 7, 0, 0, 3},
+		{"double, two players", 2, "double", 3, 2, 2, 2},
+		{"double, full bracket", 8, "double", 7, 6, 2, 0},
+		{"double, with byes", 6, "double", 7, 6, 2, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			players := make([]string, test.players)
+			for i := range players {
+				players[i] = fmt.Sprintf("seed-%d", i+1)
+			}
+
+			tournament, err := NewTournament(players, test.format, 1, DefaultMatchConfig())
+			if err != nil {
+				t.Fatalf("NewTournament() error: %v", err)
+			}
+
+			counts := make(map[string]int)
+			for _, id := range tournament.Order {
+				counts[tournament.Matches[id].Bracket]++
+			}
+			if counts["winners"] != test.winners || counts["losers"] != test.losers || counts["final"] != test.finals {
+				t.Errorf("brackets have %v matches, want %d winners, %d losers, %d final", counts, test.winners, test.losers, test.finals)
+			}
+			if len(tournament.Order) != len(tournament.Matches) {
+				t.Errorf("Order lists %d matches, Matches has %d", len(tournament.Order), len(tournament.Matches))
+			}
+
+			// every seat a result feeds into exists and is fed exactly once
+			fed := make(map[BracketSeat]int)
+			for _, id := range tournament.Order {
+				match := tournament.Matches[id]
+				for _, next := range []*BracketSeat{match.NextWin, match.NextLose} {
+					if next == nil {
+						continue
+					}
+					if _, found := tournament.Matches[next.Match]; !found {
+						t.Fatalf("%s feeds into unknown match %s", id, next.Match)
+					}
+					fed[*next]++
+				}
+			}
+			for _, id := range tournament.Order {
+				match := tournament.Matches[id]
+				firstRound := match.Bracket == "winners" && match.Round == 1
+				for seat := range 2 {
+					want := 1
+					if firstRound || match.ID == "GF2" {
+						want = 0
+					}
+					if got := fed[BracketSeat{Match: id, Seat: seat}]; got != want {
+						t.Errorf("%s seat %d is fed %d times, want %d", id, seat, got, want)
+					}
+				}
+				if !firstRound && match.Resolved != 0 {
+					t.Errorf("%s starts with %d resolved seats", id, match.Resolved)
+				}
+			}
+
+			// byes only ever leave one seat of a first round match empty
+			var byePlayers []string
+			seeded := make(map[string]string)
+			for _, id := range tournament.Order {
+				match := tournament.Matches[id]
+				if match.Bracket != "winners" || match.Round != 1 {
+					continue
+				}
+				if match.Resolved != 2 {
+					t.Errorf("%s starts with %d resolved seats, want 2", id, match.Resolved)
+				}
+				if match.Players[0] == "" && match.Players[1] == "" {
+					t.Errorf("%s has two byes", id)
+				}
+				for seat, player := range match.Players {
+					seeded[player] = id
+					if player == "" {
+						byePlayers = append(byePlayers, match.Players[1-seat])
+					}
+				}
+			}
+			delete(seeded, "")
+			if len(seeded) != test.players {
+				t.Errorf("%d players seated in the first round, want %d", len(seeded), test.players)
+			}
+			slices.Sort(byePlayers)
+			if want := players[:test.byes]; !slices.Equal(byePlayers, want) {
+				t.Errorf("byes went to %v, want %v", byePlayers, want)
+			}
+		})
+	}
+}
+
+func TestTournamentUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int64
+		taken   bool
+	}{
+		{"newer copy", 3, true},
+		{"same version", 2, false},
+		{"older copy", 1, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tournament := &Tournament{State: "playing", Version: 2}
+			saved := &Tournament{State: "finished", Champion: "a", Version: test.version}
+
+			tournament.update(saved)
+			if taken := tournament.State == "finished"; taken != test.taken {
+				t.Errorf("update() took the saved bracket %v, want %v", taken, test.taken)
+			}
+			if want := max(2, test.version); tournament.Version != want {
+				t.Errorf("version = %d, want %d", tournament.Version, want)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"sync"
 	"time"
 
@@ -25,12 +26,153 @@ type VerifyHashResponse struct {
 	Ok bool `json:"ok"`
 }
 
-type EventHandler func(conn *websocket.Conn, data interface{})
+// a client socket, either a local websocket or one relayed from another node
+type Connection interface {
+	WriteJSON(v interface{}) error
+	WriteMessage(messageType int, data []byte) error
+}
+
+// handlers get the raw event data, Handle decodes it into a typed payload
+type EventHandler func(conn Connection, hash string, data json.RawMessage) *ProtocolError
 
 type EventRouter struct {
 	handlers map[string]EventHandler
 }
 
+// a game socket that encodes what is written to it for the protocol version
+// and features the client negotiated with hello
+type ProtocolConn struct {
+	Connection
+	version  int
+	features map[string]bool
+	encoding string      // set after hello, text frames are json either way
+	admitted bool        // opened the room or proved its join code, private rooms let it in
+	reply    *EventReply // the event being handled right now
+	mutex    sync.RWMutex
+
+	// the socket takes one writer at a time, replies, broadcasts and timers all write to it
+	writeMutex sync.Mutex
+}
+
+// one broadcast message and the frames it was already encoded into, keyed by
+// ProtocolConn.frameKey, only used under the match lock
+type frameCache struct {
+	data   []byte
+	frames map[string]cachedFrame
+}
+
+type cachedFrame struct {
+	messageType int
+	data        []byte
+	send        bool
+	err         error
+}
+
+// the reply owed for an inbound event, every event with an id gets exactly one ack or error
+type EventReply struct {
+	Event string
+	ID    json.RawMessage
+	Sent  bool
+}
+
+// per-socket state of a game connection, shared by local and relayed sockets
+type GameSession struct {
+	Hash     string
+	Conn     *ProtocolConn
+	Router   *EventRouter
+	Role     string
+	PlayerID string
+}
+
+// error reply to a client event, Code is one of the Err* codes
+type ErrorPayload struct {
+	Type    string          `json:"type"`
+	ID      json.RawMessage `json:"id,omitempty"` // the id of the event that failed, when it had one
+	Event   string          `json:"event,omitempty"`
+	Code    string          `json:"code"`
+	Message string          `json:"message"`
+	Field   string          `json:"field,omitempty"`
+}
+
+type AckPayload struct {
+	Type  string          `json:"type"`
+	ID    json.RawMessage `json:"id"`
+	Event string          `json:"event"`
+}
+
+type ProtocolError struct {
+	Code    string
+	Message string
+	Field   string
+}
+
+// the data of client events, json field names match case-insensitively so
+// both playerId and playerID are accepted
+type AuthRequest struct {
+	PlayerID string `json:"playerId"` // set to reconnect to an existing seat
+	Token    string `json:"token"`    // the token from auth_ok, required with playerId from version 2 on
+	Team     string `json:"team"`
+	Identity string `json:"identity"`
+	JoinCode string `json:"joinCode"`
+	Password string `json:"password"`
+}
+
+type SetPasswordRequest struct {
+	Password string `json:"password"`
+}
+
+type SpectateRequest struct {
+	JoinCode string `json:"joinCode"`
+	Password string `json:"password"`
+}
+
+type ReconnectRequest struct {
+	PlayerID string `json:"playerId"`
+	Token    string `json:"token"`
+	LastSeq  int64  `json:"lastSeq"` // the newest seq the client saw, later room messages are replayed
+}
+
+// the answer is always for the seat the socket holds
+type SubmitAnswerRequest struct {
+	CountryCode string      `json:"countryCode"`
+	CountryName string      `json:"countryName"`
+	Lat         *float64    `json:"lat"`
+	Lon         *float64    `json:"lon"`
+	PinObject   *PinRequest `json:"pin"` // the same coordinates as {lat, lon}, instead of the top-level pair
+}
+
+type PinRequest struct {
+	Lat *float64 `json:"lat"`
+	Lon *float64 `json:"lon"`
+}
+
+type RematchRequest struct {
+	BestOf int `json:"bestOf"` // only read from the first request
+}
+
+type EmptyRequest struct{}
+
+type JoinQueueRequest struct {
+	Identity string `json:"identity"`
+	Region   string `json:"region"` // the region query parameter when empty
+}
+
+type HelloRequest struct {
+	Version    int      `json:"version"`    // the newest protocol version the client speaks
+	MinVersion int      `json:"minVersion"` // the oldest one, defaults to Version
+	Features   []string `json:"features"`
+	Encodings  []string `json:"encodings"` // wire encodings in order of preference, json when none fits
+}
+
+type HelloOkPayload struct {
+	Type       string   `json:"type"`
+	Version    int      `json:"version"`
+	Features   []string `json:"features"`
+	Encoding   string   `json:"encoding"` // used for every frame after hello_ok and its ack
+	MinVersion int      `json:"minVersion"`
+	MaxVersion int      `json:"maxVersion"`
+}
+
 type AuthPayload struct {
 	Type     string `json:"type"`
 	Hash     string `json:"hash"`
@@ -38,23 +180,70 @@ type AuthPayload struct {
 }
 
 type AuthOkPayload struct {
-	Type         string `json:"type"`
-	PlayerId     string `json:"playerId"`
-	Role         string `json:"role"` // "host" | "guest"
-	RoomState    string `json:"roomState"`
-	CurrentRound int    `json:"currentRound,omitempty"`
-	HostScore    int    `json:"hostScore,omitempty"`
-	GuestScore   int    `json:"guestScore,omitempty"`
+	Type         string         `json:"type"`
+	PlayerId     string         `json:"playerId"`        // public, it is how the room refers to this player
+	Token        string         `json:"token,omitempty"` // secret, needed with playerId to take the seat back
+	AccountId    string         `json:"accountId,omitempty"`
+	Identity     string         `json:"identity,omitempty"` // signed token to send back on auth to keep the same account
+	Rating       int            `json:"rating,omitempty"`
+	Role         string         `json:"role"` // "host" | "guest" | "player" | "spectator"
+	Seat         int            `json:"seat,omitempty"`
+	Team         string         `json:"team,omitempty"`
+	JoinCode     string         `json:"joinCode,omitempty"` // private rooms, for seated players to share
+	RoomState    string         `json:"roomState"`
+	CurrentRound int            `json:"currentRound,omitempty"`
+	HostScore    int            `json:"hostScore,omitempty"`
+	GuestScore   int            `json:"guestScore,omitempty"`
+	Scores       map[string]int `json:"scores,omitempty"`
+	TeamScores   map[string]int `json:"teamScores,omitempty"`
+	RoundCount   int            `json:"roundCount"`
+	Config       *MatchConfig   `json:"config,omitempty"`
+	Series       *SeriesState   `json:"series,omitempty"`
+}
+
+type MatchConfig struct {
+	Mode                  string `json:"mode"`                  // "1v1" | "ffa" | "teams"
+	MaxPlayers            int    `json:"maxPlayers"`            // 2 for 1v1, 3-8 for ffa, 4-8 for teams
+	TeamScoring           string `json:"teamScoring,omitempty"` // "best" | "combined", teams only
+	Region                string `json:"region,omitempty"`
+	Visibility            string `json:"visibility,omitempty"` // "public" | "unlisted" | "private", only public rooms are in discovery
+	Preset                string `json:"preset"`               // "standard" | "blitz" | "relaxed"
+	ScoringMode           string `json:"scoringMode"`          // "country" | "distance"
+	RoundCount            int    `json:"roundCount"`
+	RoundSeconds          int    `json:"roundSeconds"`
+	IntermissionSeconds   int    `json:"intermissionSeconds"`
+	ReadyTimeoutSeconds   int    `json:"readyTimeoutSeconds"`
+	SpectatorDelaySeconds int    `json:"spectatorDelaySeconds"`
 }
 
 type Match struct {
 	Hash      string
-	HostConn  *websocket.Conn
+	HostConn  Connection
 	HostID    string
-	GuestConn *websocket.Conn
+	GuestConn Connection
 	GuestID   string
 
-	GameState GameState
+	GameState  GameState
+	Config     MatchConfig
+	Spectators map[string]*Spectator
+	Players    map[string]*Player // ffa and teams rooms only, keyed by player id
+	Accounts   map[string]string  // player id to stable account id
+
+	JoinCode     string // private rooms only
+	PasswordHash string
+	PasswordSalt string
+
+	Series        *SeriesState    // set on rematches, shared score across the linked matches
+	RematchVotes  map[string]bool // player ids that asked for a rematch
+	RematchBestOf int
+	RematchHash   string // the next match once everyone agreed
+
+	TournamentID   string // set on bracket matches
+	BracketMatchID string
+
+	LastSeq          int64         // sequence number of the newest room message
+	Outbox           []OutboxEntry // replayable room messages, oldest first
+	OutboxTrimmedSeq int64         // newest sequence number that no longer is in the outbox
 
 	State     string // "waiting","ready","playing","finished"
 	Seed      int64
@@ -67,35 +256,63 @@ type Match struct {
 	mutex sync.RWMutex // protects fields inside this Match
 }
 
+type Player struct {
+	ID       string     `json:"id"`
+	Seat     int        `json:"seat"`           // 1-based, seat 1 can start the game
+	Team     string     `json:"team,omitempty"` // "red" | "blue", teams rooms only
+	Conn     Connection `json:"-"`
+	JoinedAt time.Time  `json:"joinedAt"`
+}
+
+type PlayerInfo struct {
+	PlayerID  string `json:"playerId"`
+	Seat      int    `json:"seat"`
+	Team      string `json:"team,omitempty"`
+	Connected bool   `json:"connected"`
+}
+
+type Spectator struct {
+	ID       string
+	Conn     Connection
+	JoinedAt time.Time
+}
+
 type MatchStore struct {
 	mutex   sync.RWMutex
 	matches map[string]*Match
 }
 
 type PlayerAnswer struct {
-	CountryCode string    `json:"countryCode"`
-	CountryName string    `json:"countryName"`
-	Correct     bool      `json:"correct"`
-	SubmittedAt time.Time `json:"submittedAt"`
+	CountryCode string       `json:"countryCode"`
+	CountryName string       `json:"countryName"`
+	Pin         *Coordinates `json:"pin,omitempty"`
+	Correct     bool         `json:"correct"`
+	Distance    *float64     `json:"distance,omitempty"` // km from the round's coordinates, only set when a pin was submitted
+	Points      int          `json:"points"`
+	SubmittedAt time.Time    `json:"submittedAt"`
 }
 
 type Round struct {
-	ImageURL    string        `json:"imageUrl"`
-	CountryCode string        `json:"countryCode"`
-	CountryName string        `json:"countryName"`
-	Coordinates Coordinates   `json:"coordinates"`
-	HostGuess   *PlayerAnswer `json:"hostGuess,omitempty"`
-	GuestGuess  *PlayerAnswer `json:"guestGuess,omitempty"`
-	StartedAt   time.Time     `json:"startedAt"`
-	EndTime     time.Time     `json:"endTime"`
-	Finished    bool          `json:"finished"`
+	ImageURL    string                   `json:"imageUrl"`
+	CountryCode string                   `json:"countryCode"`
+	CountryName string                   `json:"countryName"`
+	Coordinates Coordinates              `json:"coordinates"`
+	HostGuess   *PlayerAnswer            `json:"hostGuess,omitempty"`
+	GuestGuess  *PlayerAnswer            `json:"guestGuess,omitempty"`
+	Guesses     map[string]*PlayerAnswer `json:"guesses,omitempty"` // ffa rooms only, keyed by player id
+	StartedAt   time.Time                `json:"startedAt"`
+	EndTime     time.Time                `json:"endTime"`
+	Finished    bool                     `json:"finished"`
 }
 
 type GameState struct {
-	CurrentRound int      `json:"currentRound"`
-	Rounds       [5]Round `json:"rounds"`
-	HostScore    int      `json:"hostScore"`
-	GuestScore   int      `json:"guestScore"`
+	CurrentRound int            `json:"currentRound"`
+	Rounds       []Round        `json:"rounds"`
+	HostScore    int            `json:"hostScore"`
+	GuestScore   int            `json:"guestScore"`
+	Scores       map[string]int `json:"scores,omitempty"`     // ffa and teams rooms, keyed by player id
+	TeamScores   map[string]int `json:"teamScores,omitempty"` // teams rooms only, keyed by team
+	Winner       string         `json:"winner,omitempty"`     // set once the match finished, same values as game_end
 }
 
 type RoundStartPayload struct {
@@ -106,35 +323,158 @@ type RoundStartPayload struct {
 }
 
 type AnswerPayload struct {
-	Type        string `json:"type"`
-	PlayerID    string `json:"playerId"`
-	CountryCode string `json:"countryCode"`
-	CountryName string `json:"countryName"`
+	Type        string       `json:"type"`
+	PlayerID    string       `json:"playerId"`
+	CountryCode string       `json:"countryCode"`
+	CountryName string       `json:"countryName"`
+	Pin         *Coordinates `json:"pin,omitempty"`
+}
+
+type SpectatorGuessPayload struct {
+	Type        string       `json:"type"`
+	RoundIndex  int          `json:"roundIndex"`
+	Role        string       `json:"role"` // "host" | "guest" | "player"
+	PlayerID    string       `json:"playerId,omitempty"`
+	CountryCode string       `json:"countryCode"`
+	CountryName string       `json:"countryName"`
+	Pin         *Coordinates `json:"pin,omitempty"`
+	SubmittedAt time.Time    `json:"submittedAt"`
 }
 
 type RoundResultPayload struct {
-	Type        string  `json:"type"`
-	RoundIndex  int     `json:"roundIndex"`
-	HostAnswer  *string `json:"hostAnswer"`
-	GuestAnswer *string `json:"guestAnswer"`
-	CorrectCode string  `json:"correctCode"`
-	CorrectName string  `json:"correctName"`
-	HostScore   int     `json:"hostScore"`
-	GuestScore  int     `json:"guestScore"`
+	Type               string              `json:"type"`
+	RoundIndex         int                 `json:"roundIndex"`
+	HostAnswer         *string             `json:"hostAnswer"`
+	GuestAnswer        *string             `json:"guestAnswer"`
+	CorrectCode        string              `json:"correctCode"`
+	CorrectName        string              `json:"correctName"`
+	CorrectCoordinates *Coordinates        `json:"correctCoordinates,omitempty"`
+	HostDistance       *float64            `json:"hostDistance,omitempty"`
+	GuestDistance      *float64            `json:"guestDistance,omitempty"`
+	HostPoints         int                 `json:"hostPoints"`
+	GuestPoints        int                 `json:"guestPoints"`
+	HostScore          int                 `json:"hostScore"`
+	GuestScore         int                 `json:"guestScore"`
+	Results            []PlayerRoundResult `json:"results,omitempty"`
+	TeamResults        []TeamRoundResult   `json:"teamResults,omitempty"`
+}
+
+type TeamRoundResult struct {
+	Team         string `json:"team"`
+	Points       int    `json:"points"`
+	Score        int    `json:"score"`
+	BestPlayerID string `json:"bestPlayerId,omitempty"`
+}
+
+type PlayerRoundResult struct {
+	PlayerID string   `json:"playerId"`
+	Seat     int      `json:"seat"`
+	Team     string   `json:"team,omitempty"`
+	Answer   *string  `json:"answer"`
+	Correct  bool     `json:"correct"`
+	Distance *float64 `json:"distance,omitempty"`
+	Points   int      `json:"points"`
+	Score    int      `json:"score"`
+}
+
+type Standing struct {
+	Rank     int    `json:"rank"`
+	PlayerID string `json:"playerId"`
+	Seat     int    `json:"seat"`
+	Team     string `json:"team,omitempty"`
+	Score    int    `json:"score"`
+}
+
+type PlayersUpdatePayload struct {
+	Type       string       `json:"type"`
+	Players    []PlayerInfo `json:"players"`
+	MaxPlayers int          `json:"maxPlayers"`
 }
 
 type GameEndPayload struct {
-	Type       string `json:"type"`
-	HostScore  int    `json:"hostScore"`
-	GuestScore int    `json:"guestScore"`
-	Winner     string `json:"winner"` // "host", "guest", "tie"
+	Type          string         `json:"type"`
+	HostScore     int            `json:"hostScore"`
+	GuestScore    int            `json:"guestScore"`
+	Winner        string         `json:"winner"` // "host", "guest", "tie", the winning player id in ffa rooms or the winning team in teams rooms
+	Standings     []Standing     `json:"standings,omitempty"`
+	TeamScores    map[string]int `json:"teamScores,omitempty"`
+	RatingChanges []RatingChange `json:"ratingChanges,omitempty"`
+	Series        *SeriesState   `json:"series,omitempty"`
+}
+
+// the score of a run of rematches, wins are keyed like game_end winners with
+// host and guest resolved to player ids
+type SeriesState struct {
+	ID     string         `json:"id"`
+	BestOf int            `json:"bestOf"`
+	Game   int            `json:"game"` // 1-based number of the current match in the series
+	Wins   map[string]int `json:"wins"`
+	Draws  int            `json:"draws,omitempty"`
+	Hashes []string       `json:"hashes"`
+	Winner string         `json:"winner,omitempty"`
+}
+
+type RematchVotePayload struct {
+	Type     string `json:"type"`
+	PlayerID string `json:"playerId"`
+	Votes    int    `json:"votes"`
+	Required int    `json:"required"`
+	BestOf   int    `json:"bestOf"`
+}
+
+type RematchStartPayload struct {
+	Type         string       `json:"type"`
+	Hash         string       `json:"hash"`
+	PreviousHash string       `json:"previousHash"`
+	Series       *SeriesState `json:"series,omitempty"`
+}
+
+type ServerDrainingPayload struct {
+	Type     string    `json:"type"`
+	Deadline time.Time `json:"deadline"`
 }
 
 type RoomStatePayload struct {
-	Type        string `json:"type"`
-	Hash        string `json:"hash"`
-	State       string `json:"state"` // "waiting","ready","playing","finished"
-	PlayerCount int    `json:"playerCount"`
+	Type        string    `json:"type"`
+	Hash        string    `json:"hash"`
+	State       string    `json:"state"` // "waiting","ready","playing","finished"
+	PlayerCount int       `json:"playerCount"`
+	MaxPlayers  int       `json:"maxPlayers"`
+	Mode        string    `json:"mode"`
+	RoundCount  int       `json:"roundCount"`
+	Region      string    `json:"region,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// a room in the cluster wide listing, written by the node that owns it
+type ClusterRoom struct {
+	Room   RoomStatePayload `json:"room"`
+	Listed bool             `json:"listed"` // false for unlisted and private rooms
+	Node   string           `json:"node"`
+}
+
+type RoomsListPayload struct {
+	Type     string             `json:"type"`
+	Data     []RoomStatePayload `json:"data"`
+	Page     int                `json:"page"`
+	PageSize int                `json:"pageSize"`
+	Total    int                `json:"total"`
+}
+
+// zero values match every room
+type DiscoveryFilter struct {
+	State      string `json:"state,omitempty"`
+	Mode       string `json:"mode,omitempty"`
+	RoundCount int    `json:"rounds,omitempty"`
+	Region     string `json:"region,omitempty"`
+	OpenSeat   bool   `json:"openSeat,omitempty"`
+}
+
+type DiscoverySubscriber struct {
+	Conn    *websocket.Conn
+	Filter  DiscoveryFilter
+	visible map[string]bool // rooms this client has been told match its filter
+	mutex   sync.Mutex
 }
 
 type ReconnectPayload struct {
@@ -144,9 +484,215 @@ type ReconnectPayload struct {
 }
 
 type ReconnectOkPayload struct {
-	Type      string     `json:"type"`
-	PlayerId  string     `json:"playerId"`
-	Role      string     `json:"role"` // "host" | "guest"
-	RoomState string     `json:"roomState"`
-	GameState *GameState `json:"gameState,omitempty"`
+	Type           string     `json:"type"`
+	PlayerId       string     `json:"playerId"`
+	Role           string     `json:"role"` // "host" | "guest" | "player"
+	RoomState      string     `json:"roomState"`
+	RoundCount     int        `json:"roundCount"`
+	GameState      *GameState `json:"gameState,omitempty"`
+	Seq            int64      `json:"seq"`            // newest room message, the replay follows right after
+	Replayed       int        `json:"replayed"`       // how many messages are replayed
+	ReplayComplete bool       `json:"replayComplete"` // false when some missed messages were too old to keep
+}
+
+// a sequenced room message kept for replay
+type OutboxEntry struct {
+	Seq  int64           `json:"seq"`
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+type MatchSnapshot struct {
+	Hash         string             `json:"hash"`
+	HostID       string             `json:"hostId"`
+	GuestID      string             `json:"guestId"`
+	Players      map[string]*Player `json:"players,omitempty"`
+	Accounts     map[string]string  `json:"accounts,omitempty"`
+	JoinCode     string             `json:"joinCode,omitempty"`
+	PasswordHash string             `json:"passwordHash,omitempty"`
+	PasswordSalt string             `json:"passwordSalt,omitempty"`
+	Series       *SeriesState       `json:"series,omitempty"`
+	RematchHash  string             `json:"rematchHash,omitempty"`
+	Tournament   string             `json:"tournament,omitempty"`
+	BracketMatch string             `json:"bracketMatch,omitempty"`
+	LastSeq      int64              `json:"lastSeq,omitempty"`
+	Outbox       []OutboxEntry      `json:"outbox,omitempty"`
+	TrimmedSeq   int64              `json:"trimmedSeq,omitempty"`
+	State        string             `json:"state"`
+	Seed         int64              `json:"seed"`
+	CreatedAt    time.Time          `json:"createdAt"`
+	GameReady    bool               `json:"gameReady"`
+	Config       MatchConfig        `json:"config"`
+	GameState    GameState          `json:"gameState"`
+	Owner        string             `json:"owner"`
+	SavedAt      time.Time          `json:"savedAt"`
+}
+
+// a socket held by another node, written to through redis pub/sub
+type RelayConn struct {
+	SessionID string
+}
+
+type relayedSession struct {
+	session *GameSession
+	inbox   chan relayedFrame
+}
+
+type relayedFrame struct {
+	messageType int
+	data        []byte
+}
+
+type RelayEnvelope struct {
+	Kind      string       `json:"kind"` // "open" | "message" | "close"
+	SessionID string       `json:"sessionId"`
+	Hash      string       `json:"hash"`
+	Origin    string       `json:"origin"`
+	Config    *MatchConfig `json:"config,omitempty"`
+	Admitted  bool         `json:"admitted,omitempty"` // the origin checked the join code in the url
+	Payload   string       `json:"payload,omitempty"`
+	Binary    []byte       `json:"binary,omitempty"` // binary frames, which a string payload would mangle
+}
+
+type AdminMatchSummary struct {
+	Hash           string    `json:"hash"`
+	Mode           string    `json:"mode"`
+	State          string    `json:"state"`
+	PlayerCount    int       `json:"playerCount"`
+	SpectatorCount int       `json:"spectatorCount"`
+	CurrentRound   int       `json:"currentRound"`
+	RoundCount     int       `json:"roundCount"`
+	CreatedAt      time.Time `json:"createdAt"`
+	AgeSeconds     int64     `json:"ageSeconds"`
+	Node           string    `json:"node"` // the node that owns the match
+}
+
+type AdminMatchDetail struct {
+	AdminMatchSummary
+	HostID    string       `json:"hostId,omitempty"`
+	GuestID   string       `json:"guestId,omitempty"`
+	Players   []PlayerInfo `json:"players,omitempty"`
+	Config    MatchConfig  `json:"config"`
+	GameState *GameState   `json:"gameState"`
+}
+
+type MatchHistoryRecord struct {
+	ID         string         `json:"id"`
+	Hash       string         `json:"hash"`
+	Mode       string         `json:"mode"`
+	Config     MatchConfig    `json:"config"`
+	PlayerIDs  []string       `json:"playerIds"`
+	AccountIDs []string       `json:"accountIds"`
+	HostID     string         `json:"hostId,omitempty"`
+	GuestID    string         `json:"guestId,omitempty"`
+	Rounds     []Round        `json:"rounds"` // only the rounds that were played
+	HostScore  int            `json:"hostScore"`
+	GuestScore int            `json:"guestScore"`
+	Scores     map[string]int `json:"scores,omitempty"`
+	TeamScores map[string]int `json:"teamScores,omitempty"`
+	Winner     string         `json:"winner"`
+	Standings  []Standing     `json:"standings,omitempty"`
+	CreatedAt  time.Time      `json:"createdAt"`
+	FinishedAt time.Time      `json:"finishedAt"`
+}
+
+type PlayerRating struct {
+	AccountID string    `json:"accountId"`
+	Rating    int       `json:"rating"`
+	Games     int       `json:"games"`
+	Wins      int       `json:"wins"`
+	Losses    int       `json:"losses"`
+	Draws     int       `json:"draws"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type RatingChange struct {
+	PlayerID  string `json:"playerId"`
+	AccountID string `json:"accountId"`
+	OldRating int    `json:"oldRating"`
+	NewRating int    `json:"newRating"`
+	Delta     int    `json:"delta"`
+}
+
+type MatchmakingTicket struct {
+	ID        string     `json:"id"`
+	AccountID string     `json:"accountId"`
+	Rating    int        `json:"rating"`
+	Region    string     `json:"region,omitempty"` // "" matches every region
+	Node      string     `json:"node"`             // the node holding the socket
+	Conn      Connection `json:"-"`
+	JoinedAt  time.Time  `json:"joinedAt"`
+}
+
+// a matchmaking socket, its ticket is only touched by its own read loop
+type MatchmakingSession struct {
+	Conn   *ProtocolConn
+	Region string // from the query, for join_queue without one
+	Ticket *MatchmakingTicket
+}
+
+// match_found for a ticket whose socket is on another node
+type MatchFoundNotice struct {
+	TicketID string            `json:"ticketId"`
+	Payload  MatchFoundPayload `json:"payload"`
+}
+
+type QueueJoinedPayload struct {
+	Type      string `json:"type"`
+	AccountId string `json:"accountId"`
+	Identity  string `json:"identity"`
+	Rating    int    `json:"rating"`
+	Region    string `json:"region,omitempty"`
+	QueueSize int    `json:"queueSize"`
+}
+
+type MatchFoundPayload struct {
+	Type           string `json:"type"`
+	Hash           string `json:"hash"`
+	Region         string `json:"region,omitempty"`
+	Rating         int    `json:"rating"`
+	OpponentRating int    `json:"opponentRating"`
+}
+
+type Tournament struct {
+	ID        string                   `json:"id"`
+	Format    string                   `json:"format"` // "single" | "double"
+	BestOf    int                      `json:"bestOf"` // games per bracket match
+	Players   []string                 `json:"players"`
+	Config    MatchConfig              `json:"config"`
+	Matches   map[string]*BracketMatch `json:"matches"`
+	Order     []string                 `json:"order"` // bracket match ids in play order
+	State     string                   `json:"state"` // "playing" | "finished"
+	Champion  string                   `json:"champion,omitempty"`
+	CreatedAt time.Time                `json:"createdAt"`
+	Version   int64                    `json:"version"` // bumped on every save
+
+	mutex sync.Mutex
+}
+
+// one pairing of a bracket, played as a series of up to BestOf games
+type BracketMatch struct {
+	ID       string       `json:"id"`      // "W1-1", "L2-1", "GF", "GF2"
+	Bracket  string       `json:"bracket"` // "winners" | "losers" | "final"
+	Round    int          `json:"round"`
+	Players  [2]string    `json:"players"`  // "" is a bye or a seat not decided yet
+	Resolved int          `json:"resolved"` // how many seats are decided
+	Wins     [2]int       `json:"wins"`
+	Hash     string       `json:"hash,omitempty"` // the game being played right now
+	Hashes   []string     `json:"hashes,omitempty"`
+	State    string       `json:"state"` // "pending" | "playing" | "finished" | "skipped", only GF2 is ever skipped
+	Winner   string       `json:"winner,omitempty"`
+	Loser    string       `json:"loser,omitempty"`
+	NextWin  *BracketSeat `json:"nextWin,omitempty"`
+	NextLose *BracketSeat `json:"nextLose,omitempty"`
+}
+
+type BracketSeat struct {
+	Match string `json:"match"`
+	Seat  int    `json:"seat"` // 0 or 1
+}
+
+type TournamentUpdatePayload struct {
+	Type       string      `json:"type"`
+	Tournament *Tournament `json:"tournament"`
 }
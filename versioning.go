@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+// clients that never send hello speak version 1, the shape from before versioning
+const MinProtocolVersion int = 1
+const MaxProtocolVersion int = 2
+const DefaultProtocolVersion int = 1
+
+// optional features a client can ask for in hello
+var ServerFeatures = []string{"rematch", "spectator_guesses"}
+
+// message types a version 2+ client only gets after negotiating their feature,
+// version 1 clients predate features and keep getting every message
+var featureMessages = map[string]string{
+	"rematch_requested": "rematch",
+	"rematch_start":     "rematch",
+	"spectator_guess":   "spectator_guesses",
+}
+
+// fields that only make sense in 1v1 rooms, dropped from multiplayer results from version 2 on
+var versionTwoDroppedFields = map[string][]string{
+	"round_result": {"hostAnswer", "guestAnswer", "hostDistance", "guestDistance", "hostPoints", "guestPoints", "hostScore", "guestScore"},
+	"game_end":     {"hostScore", "guestScore"},
+}
+
+func NewProtocolConn(conn Connection) *ProtocolConn {
+	return &ProtocolConn{Connection: conn, version: DefaultProtocolVersion}
+}
+
+func (conn *ProtocolConn) Version() int {
+	conn.mutex.RLock()
+	defer conn.mutex.RUnlock()
+
+	return conn.version
+}
+
+func (conn *ProtocolConn) HasFeature(feature string) bool {
+	conn.mutex.RLock()
+	defer conn.mutex.RUnlock()
+
+	return conn.features[feature]
+}
+
+// picks the newest version both sides speak and the features both support
+func (conn *ProtocolConn) Negotiate(hello *HelloRequest) (HelloOkPayload, *ProtocolError) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	if conn.features != nil {
+		return HelloOkPayload{}, NewProtocolError(ErrInvalidState, "Protocol already negotiated")
+	}
+
+	version := min(hello.Version, MaxProtocolVersion)
+	if version < max(hello.MinVersion, MinProtocolVersion) {
+		return HelloOkPayload{}, &ProtocolError{
+			Code:    ErrUnsupportedVersion,
+			Message: fmt.Sprintf("Supported protocol versions are %d to %d", MinProtocolVersion, MaxProtocolVersion),
+			Field:   "version",
+		}
+	}
+
+	features := make([]string, 0)
+	conn.features = make(map[string]bool)
+	for _, feature := range hello.Features {
+		if slices.Contains(ServerFeatures, feature) && !conn.features[feature] {
+			conn.features[feature] = true
+			features = append(features, feature)
+		}
+	}
+	conn.version = version
+
+	return HelloOkPayload{
+		Type:       "hello_ok",
+		Version:    version,
+		Features:   features,
+		Encoding:   pickEncoding(hello.Encodings),
+		MinVersion: MinProtocolVersion,
+		MaxVersion: MaxProtocolVersion,
+	}, nil
+}
+
+func (conn *ProtocolConn) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// rewrites text frames for the connection's version and encoding, frames it
+// should not get are dropped
+func (conn *ProtocolConn) WriteMessage(messageType int, data []byte) error {
+	if messageType != websocket.TextMessage {
+		return conn.write(messageType, data)
+	}
+
+	messageType, data, send, err := conn.encodeText(data)
+	if err != nil || !send {
+		return err
+	}
+	return conn.write(messageType, data)
+}
+
+// every frame goes out through here so concurrent writers take turns
+func (conn *ProtocolConn) write(messageType int, data []byte) error {
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+
+	return conn.Connection.WriteMessage(messageType, data)
+}
+
+// the frame a json text message becomes on this connection, send is false
+// when the connection should not get the message at all
+func (conn *ProtocolConn) encodeText(data []byte) (int, []byte, bool, error) {
+	if conn.Version() >= 2 {
+		var send bool
+		if data, send = conn.encodeVersionTwo(data); !send {
+			return 0, nil, false, nil
+		}
+	}
+
+	messageType, data, err := conn.encodeFrame(data)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	return messageType, data, true, nil
+}
+
+// connections with the same key turn a message into the same frame
+func (conn *ProtocolConn) frameKey() string {
+	conn.mutex.RLock()
+	defer conn.mutex.RUnlock()
+
+	features := make([]string, 0, len(conn.features))
+	for feature := range conn.features {
+		features = append(features, feature)
+	}
+	slices.Sort(features)
+	return fmt.Sprintf("%d|%s|%s", conn.version, strings.Join(features, ","), conn.encoding)
+}
+
+func newFrameCache(data []byte) *frameCache {
+	return &frameCache{data: data, frames: make(map[string]cachedFrame)}
+}
+
+// writes the message, encoding it only the first time a connection of this shape needs it
+func (cache *frameCache) Write(conn Connection) error {
+	protocolConn, ok := conn.(*ProtocolConn)
+	if !ok {
+		return conn.WriteMessage(websocket.TextMessage, cache.data)
+	}
+
+	key := protocolConn.frameKey()
+	frame, found := cache.frames[key]
+	if !found {
+		frame.messageType, frame.data, frame.send, frame.err = protocolConn.encodeText(cache.data)
+		cache.frames[key] = frame
+	}
+	if frame.err != nil || !frame.send {
+		return frame.err
+	}
+	return protocolConn.write(frame.messageType, frame.data)
+}
+
+func (conn *ProtocolConn) encodeVersionTwo(data []byte) ([]byte, bool) {
+	var message map[string]json.RawMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		// version 2 only sends json, bare text frames like pong get wrapped
+		wrapped, _ := json.Marshal(map[string]string{"type": string(data)})
+		return wrapped, true
+	}
+
+	var messageType string
+	json.Unmarshal(message["type"], &messageType)
+
+	if feature, ok := featureMessages[messageType]; ok && !conn.HasFeature(feature) {
+		return nil, false
+	}
+
+	_, multiplayer := message["results"]
+	if _, hasStandings := message["standings"]; hasStandings {
+		multiplayer = true
+	}
+	fields, ok := versionTwoDroppedFields[messageType]
+	if !ok || !multiplayer {
+		return data, true
+	}
+	for _, field := range fields {
+		delete(message, field)
+	}
+	encoded, err := json.Marshal(message)
+	if err != nil {
+		return data, true
+	}
+	return encoded, true
+}
+
+// the socket underneath, for code that needs to close it
+func unwrapConnection(conn Connection) Connection {
+	if protocolConn, ok := conn.(*ProtocolConn); ok {
+		return protocolConn.Connection
+	}
+	return conn
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const JoinCodeLength int = 6
+const MaxRoomPasswordLength int = 64
+
+// no 0/O or 1/I so codes can be read out loud
+const joinCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+func joinCodeKey(code string) string {
+	return "geofinder:joincode:" + code
+}
+
+func GenerateJoinCode() string {
+	random := make([]byte, JoinCodeLength)
+	rand.Read(random)
+
+	code := make([]byte, JoinCodeLength)
+	for i, b := range random {
+		code[i] = joinCodeAlphabet[int(b)%len(joinCodeAlphabet)]
+	}
+	return string(code)
+}
+
+func hashRoomPassword(salt string, password string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(password))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (match *Match) IsListed() bool {
+	return match.Config.Visibility == "" || match.Config.Visibility == "public"
+}
+
+// join codes registered while running without redis, code to room hash
+var localJoinCodes = make(map[string]string)
+var localJoinCodesMutex sync.Mutex
+
+// registers the code for the room unless another room already has it
+func claimJoinCode(code string, hash string) (bool, error) {
+	if redisClient == nil {
+		localJoinCodesMutex.Lock()
+		defer localJoinCodesMutex.Unlock()
+
+		if _, taken := localJoinCodes[code]; taken {
+			return false, nil
+		}
+		localJoinCodes[code] = hash
+		return true, nil
+	}
+
+	ctx := context.Background()
+	return redisClient.SetNX(ctx, joinCodeKey(code), hash, matchStateTTL).Result()
+}
+
+// gives a private room its join code and registers the code so it can be looked up
+func (store *MatchStore) protectMatch(match *Match) {
+	if match.Config.Visibility != "private" || match.JoinCode != "" {
+		return
+	}
+
+	for range 5 {
+		code := GenerateJoinCode()
+		claimed, err := claimJoinCode(code, match.Hash)
+		if err != nil {
+			// a code that isn't registered would never find the room
+			LogRedisError("join_code", err)
+			continue
+		}
+		if claimed {
+			match.JoinCode = code
+			return
+		}
+	}
+	LogMatchLifecycle(match.Hash, "join_code_failed", logrus.Fields{})
+}
+
+func (store *MatchStore) SetRoomPassword(hash string, password string) error {
+	match, exists := store.GetMatch(hash)
+	if !exists {
+		return fmt.Errorf("Match %s not found", hash)
+	}
+
+	random := make([]byte, 16)
+	rand.Read(random)
+	salt := hex.EncodeToString(random)
+
+	match.mutex.Lock()
+	match.PasswordSalt = salt
+	match.PasswordHash = hashRoomPassword(salt, password)
+	match.mutex.Unlock()
+
+	store.SaveMatch(hash)
+	return nil
+}
+
+// the room hash behind a join code, empty if the code is unknown
+func LookupJoinCode(code string) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if len(code) != JoinCodeLength {
+		return ""
+	}
+
+	if redisClient == nil {
+		localJoinCodesMutex.Lock()
+		defer localJoinCodesMutex.Unlock()
+
+		return localJoinCodes[code]
+	}
+
+	ctx := context.Background()
+	hash, err := redisClient.Get(ctx, joinCodeKey(code)).Result()
+	if err != nil {
+		return ""
+	}
+	return hash
+}
+
+func ReleaseJoinCode(code string) {
+	if code == "" {
+		return
+	}
+	if redisClient == nil {
+		localJoinCodesMutex.Lock()
+		delete(localJoinCodes, code)
+		localJoinCodesMutex.Unlock()
+		return
+	}
+
+	ctx := context.Background()
+	if err := redisClient.Del(ctx, joinCodeKey(code)).Err(); err != nil {
+		LogRedisError("join_code", err)
+	}
+}
+
+// lets the socket into a private room without asking for the code again
+func (conn *ProtocolConn) Admit() {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	conn.admitted = true
+}
+
+func connAdmitted(conn Connection) bool {
+	protocolConn, ok := conn.(*ProtocolConn)
+	if !ok {
+		return false
+	}
+
+	protocolConn.mutex.RLock()
+	defer protocolConn.mutex.RUnlock()
+	return protocolConn.admitted
+}
+
+// checks the join code or password before a new player or spectator gets into a
+// private room, sockets that opened the room or came in with its code get through
+func (store *MatchStore) CheckRoomAccess(hash string, conn Connection, joinCode string, password string) error {
+	match, exists := store.GetMatch(hash)
+	if !exists {
+		return fmt.Errorf("Match %s not found", hash)
+	}
+
+	match.mutex.RLock()
+	defer match.mutex.RUnlock()
+
+	if match.Config.Visibility != "private" || connAdmitted(conn) {
+		return nil
+	}
+
+	joinCode = strings.ToUpper(strings.TrimSpace(joinCode))
+	if joinCode != "" && subtle.ConstantTimeCompare([]byte(joinCode), []byte(match.JoinCode)) == 1 {
+		return nil
+	}
+	if password != "" && match.PasswordHash != "" {
+		given := hashRoomPassword(match.PasswordSalt, password)
+		if subtle.ConstantTimeCompare([]byte(given), []byte(match.PasswordHash)) == 1 {
+			return nil
+		}
+	}
+	return fmt.Errorf("Join code or password required")
+}